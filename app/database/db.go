@@ -97,6 +97,9 @@ func createTables() error {
       resized_data BLOB,
       content_type TEXT,
       response_format TEXT,
+      orig_width INTEGER NOT NULL DEFAULT 0,
+      orig_height INTEGER NOT NULL DEFAULT 0,
+      pages INTEGER NOT NULL DEFAULT 0,
       created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
       UNIQUE(url, cache_key)
     );
@@ -107,6 +110,10 @@ func createTables() error {
 		}
 	}
 
+	if err := addSourceMetaColumns(); err != nil {
+		return fmt.Errorf("failed to add source metadata columns: %w", err)
+	}
+
 	log.Println("Database initialized successfully")
 	return nil
 }
@@ -187,6 +194,52 @@ func migrateOldSchema() bool {
 	return false
 }
 
+// addSourceMetaColumns adds the orig_width/orig_height and pages columns to
+// caches created before source entries recorded the original image size and
+// page count. Existing rows keep 0 (unknown).
+func addSourceMetaColumns() error {
+	rows, err := DB.Query("PRAGMA table_info(image_cache)")
+	if err != nil {
+		return err
+	}
+	hasOrigWidth, hasPages := false, false
+	for rows.Next() {
+		var cid int
+		var name, typ string
+		var notnull int
+		var dfltValue sql.NullString
+		var pk int
+		if err := rows.Scan(&cid, &name, &typ, &notnull, &dfltValue, &pk); err != nil {
+			continue
+		}
+		switch name {
+		case "orig_width":
+			hasOrigWidth = true
+		case "pages":
+			hasPages = true
+		}
+	}
+	rows.Close()
+
+	var migrations []string
+	if !hasOrigWidth {
+		log.Println("Adding original dimension columns to image_cache...")
+		migrations = append(migrations,
+			`ALTER TABLE image_cache ADD COLUMN orig_width INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE image_cache ADD COLUMN orig_height INTEGER NOT NULL DEFAULT 0`)
+	}
+	if !hasPages {
+		log.Println("Adding page count column to image_cache...")
+		migrations = append(migrations, `ALTER TABLE image_cache ADD COLUMN pages INTEGER NOT NULL DEFAULT 0`)
+	}
+	for _, m := range migrations {
+		if _, err := DB.Exec(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func GetCachedImage(url string, cacheKey string) ([]byte, string, string, error) {
 	var data []byte
 	var contentType string
@@ -242,6 +295,72 @@ func CacheImage(url string, cacheKey string, resizedData []byte, contentType, re
 	return fmt.Errorf("failed to cache image after retries: %w", err)
 }
 
+// SourceMeta describes a cached source entry
+type SourceMeta struct {
+	Format     string // original format ("jpeg", "pdf", ...)
+	OrigWidth  int    // original image size, 0 when not recorded
+	OrigHeight int
+	Pages      int // page count of documents, 0 when not recorded
+}
+
+// GetCachedSource is GetCachedImage for source entries: returns the data and
+// the source metadata.
+func GetCachedSource(url string, cacheKey string) ([]byte, SourceMeta, error) {
+	var data []byte
+	var meta SourceMeta
+
+	query := `
+    SELECT resized_data, response_format, orig_width, orig_height, pages
+    FROM image_cache
+    WHERE url = ? AND cache_key = ?
+    LIMIT 1
+  `
+
+	// Retry logic for busy database
+	var err error
+	for i := 0; i < 3; i++ {
+		err = DB.QueryRow(query, url, cacheKey).Scan(&data, &meta.Format, &meta.OrigWidth, &meta.OrigHeight, &meta.Pages)
+		if err == nil || err == sql.ErrNoRows {
+			break
+		}
+		if i < 2 {
+			time.Sleep(time.Millisecond * 50)
+		}
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, SourceMeta{}, nil
+	}
+	if err != nil {
+		return nil, SourceMeta{}, fmt.Errorf("database query failed after retries: %w", err)
+	}
+
+	return data, meta, nil
+}
+
+// CacheSource is CacheImage for source entries, recording the original image
+// dimensions and page count next to the (possibly downscaled) source data.
+func CacheSource(url string, cacheKey string, data []byte, contentType string, meta SourceMeta) error {
+	query := `
+    INSERT OR REPLACE INTO image_cache (url, cache_key, resized_data, content_type, response_format, orig_width, orig_height, pages)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+  `
+
+	// Retry logic for busy database
+	var err error
+	for i := 0; i < 3; i++ {
+		_, err = DB.Exec(query, url, cacheKey, data, contentType, meta.Format, meta.OrigWidth, meta.OrigHeight, meta.Pages)
+		if err == nil {
+			return nil
+		}
+		if i < 2 {
+			time.Sleep(time.Millisecond * 50)
+		}
+	}
+
+	return fmt.Errorf("failed to cache source after retries: %w", err)
+}
+
 // CachedImageInfo holds metadata about a cached image (without the blob data)
 type CachedImageInfo struct {
 	ID           int    `json:"id"`
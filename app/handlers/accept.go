@@ -0,0 +1,145 @@
+package handlers
+
+// Accept header negotiation.
+//
+// The Accept header is parsed into media ranges with q-values. A negotiable
+// output format counts as supported only when the client lists its exact media
+// type with q > 0: wildcards (image/*, */*) don't imply support for modern
+// formats - older browsers send image/* without decoding AVIF - but an exact
+// "image/avif;q=0" rules AVIF out. Supported formats are ordered by q-value,
+// ties broken by server preference (negotiableFormats order).
+//
+// Wildcards do rank the fallback: JPEG/PNG get the q of their most specific
+// range (exact, image/*, then */*), and a format the client rates below them
+// is dropped, so "image/webp;q=0.5,image/*" gets the original format.
+// "image/*;q=0" leaves the fallback unranked; it's still served when nothing
+// else is accepted.
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// negotiableFormats are the Accept-negotiated output formats in server
+// preference order (best compression first). Sources fall back to their
+// original format (encodeFallback) when none is accepted. InitJXL adds JXL
+// before or after AVIF when libvips can encode it.
+var negotiableFormats = []struct {
+	name string
+	mime string
+}{
+	{"avif", "image/avif"},
+	{"webp", "image/webp"},
+}
+
+// mediaRange is one parsed Accept entry ("image/webp;q=0.8")
+type mediaRange struct {
+	mainType string
+	subType  string
+	q        float64
+}
+
+// parseAccept parses an Accept header into media ranges. Entries with an
+// invalid media type or q-value are skipped.
+func parseAccept(header string) []mediaRange {
+	var ranges []mediaRange
+	for _, entry := range strings.Split(header, ",") {
+		parts := strings.Split(entry, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(parts[0]))
+		if mediaType == "*" {
+			mediaType = "*/*" // seen from some clients, treated as */*
+		}
+		mainType, subType, ok := strings.Cut(mediaType, "/")
+		if !ok || mainType == "" || subType == "" {
+			continue
+		}
+
+		q := 1.0
+		valid := true
+		for _, param := range parts[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || v < 0 || v > 1 {
+				valid = false
+				break
+			}
+			q = v
+		}
+		if valid {
+			ranges = append(ranges, mediaRange{mainType: mainType, subType: subType, q: q})
+		}
+	}
+	return ranges
+}
+
+// exactQuality returns the q-value of an exact media type entry, and whether
+// the type is listed at all. Repeated entries keep the highest q.
+func exactQuality(ranges []mediaRange, mime string) (float64, bool) {
+	mainType, subType, _ := strings.Cut(mime, "/")
+	q, listed := 0.0, false
+	for _, mr := range ranges {
+		if mr.mainType == mainType && mr.subType == subType {
+			if !listed || mr.q > q {
+				q = mr.q
+			}
+			listed = true
+		}
+	}
+	return q, listed
+}
+
+// rangeQuality returns the q-value of the most specific range matching mime:
+// the exact type, then type/*, then */*. 0 when none matches.
+func rangeQuality(ranges []mediaRange, mime string) float64 {
+	if q, listed := exactQuality(ranges, mime); listed {
+		return q
+	}
+	mainType, _, _ := strings.Cut(mime, "/")
+	for _, wildcard := range []string{mainType + "/*", "*/*"} {
+		if q, listed := exactQuality(ranges, wildcard); listed {
+			return q
+		}
+	}
+	return 0
+}
+
+// fallbackQuality is the q-value the client gives the fallback formats,
+// the better of JPEG and PNG
+func fallbackQuality(ranges []mediaRange) float64 {
+	return math.Max(rangeQuality(ranges, "image/jpeg"), rangeQuality(ranges, "image/png"))
+}
+
+// negotiateFormats returns the negotiable formats the Accept header supports,
+// best first. Empty when the client only gets the fallback format.
+func negotiateFormats(accept string) []string {
+	ranges := parseAccept(accept)
+	fallbackQ := fallbackQuality(ranges)
+
+	type candidate struct {
+		name string
+		q    float64
+	}
+	var candidates []candidate
+	for _, f := range negotiableFormats {
+		// Rated below JPEG/PNG: the client would rather have the fallback
+		if q, listed := exactQuality(ranges, f.mime); listed && q > 0 && q >= fallbackQ {
+			candidates = append(candidates, candidate{f.name, q})
+		}
+	}
+	// Stable: equal q-values keep the server preference order
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	formats := make([]string, len(candidates))
+	for i, c := range candidates {
+		formats[i] = c.name
+	}
+	return formats
+}
+
+// NegotiateFormatsForTest exposes negotiateFormats for tests
+func NegotiateFormatsForTest(accept string) []string { return negotiateFormats(accept) }
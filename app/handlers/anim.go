@@ -0,0 +1,223 @@
+package handlers
+
+// Animated GIF and WebP.
+//
+// Animated sources keep every frame: the source is cached as an animated
+// WebP with each frame capped at MAX_SIZE, and resize variants run the whole
+// pipeline (rect, trim, resize, filters, overlays) frame by frame, keeping the
+// frame delays and loop count. Output follows Accept negotiation: animated
+// AVIF where libvips can write AVIF sequences (probed at startup, see
+// InitAnimatedAVIF), animated WebP, and animated GIF for clients accepting
+// neither. Each lands under its own format cache key. f=gif and f=webp (and
+// f=avif when supported) force one of them.
+//
+//   anim=0 - first frame only, encoded like any still image (AVIF, WebP,
+//            PNG for GIF sources without either)
+//
+// Other forced formats (f=png, f=jpg) get the first frame.
+// g=attention/entropy is worked out per frame; trim= falls back to the first
+// frame when the frames trim to different sizes.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// AnimatedAVIF reports whether libvips writes animated AVIF (InitAnimatedAVIF)
+var AnimatedAVIF bool
+
+// InitAnimatedAVIF probes whether this libvips/libheif build writes AVIF
+// sequences with frame timing: older builds save the first frame or a set of
+// untimed images. Must be called after vips.Startup().
+func InitAnimatedAVIF() {
+	AnimatedAVIF = probeAnimatedAVIF()
+	if AnimatedAVIF {
+		log.Printf("Animated AVIF output enabled")
+	} else {
+		log.Printf("Animated AVIF not supported by libvips, animations use WebP/GIF")
+	}
+}
+
+// probeAnimatedAVIF round-trips a two-frame animation through AVIF and checks
+// both frames and their delays survive.
+func probeAnimatedAVIF() bool {
+	img, err := vips.Black(8, 16)
+	if err != nil {
+		return false
+	}
+	defer img.Close()
+	delay := []int{100, 200}
+	if img.ToColorSpace(vips.InterpretationSRGB) != nil || img.SetPageHeight(8) != nil ||
+		img.SetPages(2) != nil || img.SetPageDelay(delay) != nil {
+		return false
+	}
+	data, err := encodeAVIF(img, 50)
+	if err != nil {
+		return false
+	}
+
+	importParams := vips.NewImportParams()
+	importParams.NumPages.Set(-1)
+	back, err := vips.LoadImageFromBuffer(data, importParams)
+	if err != nil {
+		return false
+	}
+	defer back.Close()
+	got, err := back.PageDelay()
+	return err == nil && frameCount(back) == 2 && len(got) == 2 && got[0] == delay[0] && got[1] == delay[1]
+}
+
+// isAnimatedFormat reports whether an output format carries all frames
+func isAnimatedFormat(format string) bool {
+	return format == "gif" || format == "webp" || (format == "avif" && AnimatedAVIF)
+}
+
+// parseAnim parses anim=0|1 into params; anim=0 adds an "anim0" cache key token.
+func parseAnim(q url.Values, params *ResizeParams) error {
+	switch q.Get("anim") {
+	case "", "1", "true":
+	case "0", "false":
+		params.Still = true
+		params.appendCacheKey("anim0")
+	default:
+		return fmt.Errorf("invalid anim, use anim=0 for the first frame only")
+	}
+	return nil
+}
+
+// isAnimatable reports whether a decoded source may hold several frames
+func isAnimatable(format string) bool {
+	return format == "gif" || format == "webp"
+}
+
+// loadSourceImage decodes a cached source. Animated sources load every frame
+// unless the request only needs the first one.
+func loadSourceImage(source *sourceResult, params *ResizeParams) (*vips.ImageRef, error) {
+	if !isAnimatable(source.format) || params.Still || (params.Format != "" && !isAnimatedFormat(params.Format)) {
+		return vips.NewImageFromBuffer(source.data)
+	}
+	importParams := vips.NewImportParams()
+	importParams.NumPages.Set(-1)
+	return vips.LoadImageFromBuffer(source.data, importParams)
+}
+
+// frameCount returns the number of frames loaded into img (1 for stills)
+func frameCount(img *vips.ImageRef) int {
+	ph := img.PageHeight()
+	if ph <= 0 || ph >= img.Height() {
+		return 1
+	}
+	return img.Height() / ph
+}
+
+// extractFrame copies frame i out of an animation's stacked frames.
+func extractFrame(img *vips.ImageRef, i int) (*vips.ImageRef, error) {
+	ph := img.PageHeight()
+	frame, err := img.Copy()
+	if err != nil {
+		return nil, err
+	}
+	// A single full-height page, so ExtractArea cuts once instead of per page
+	err = frame.SetPages(1)
+	if err == nil {
+		err = frame.SetPageHeight(frame.Height())
+	}
+	if err == nil {
+		err = frame.ExtractArea(0, i*ph, frame.Width(), ph)
+	}
+	if err != nil {
+		frame.Close()
+		return nil, err
+	}
+	return frame, nil
+}
+
+// enforceMaxSizeAnimated is enforceMaxSize for stacked frames: the limit
+// applies to each frame and the page height is kept exact. Modifies in place.
+func enforceMaxSizeAnimated(img *vips.ImageRef) error {
+	width, ph := img.Width(), img.PageHeight()
+	if width <= MaxSize && ph <= MaxSize {
+		return nil
+	}
+	scale := math.Min(float64(MaxSize)/float64(width), float64(MaxSize)/float64(ph))
+	newPH := max(int(math.Round(float64(ph)*scale)), 1)
+
+	log.Printf("Enforcing max size on %d frames: original=%dx%d, max=%d, scale=%.3f",
+		frameCount(img), width, ph, MaxSize, scale)
+
+	// vscale from the rounded page height so the frames stack evenly
+	return img.ResizeWithVScale(scale, float64(newPH)/float64(ph), vips.KernelLanczos3)
+}
+
+// processAnimation runs processImage on every frame of img and stacks the
+// results into a new animation with the source's delays and loop count.
+// Falls back to the first frame when the frames come out at different sizes.
+func processAnimation(ctx context.Context, img *vips.ImageRef, source *sourceResult, params *ResizeParams, overlay *watermarkOverlay) (*vips.ImageRef, string, error) {
+	n := frameCount(img)
+	delay, err := img.PageDelay()
+	if err != nil {
+		return nil, "", fmt.Errorf("anim-failed; %v", err)
+	}
+	loop := img.Loop()
+
+	// Every frame but the returned one is closed on the way out
+	var out *vips.ImageRef
+	frames := make([]*vips.ImageRef, 0, n)
+	defer func() {
+		for _, f := range frames {
+			if f != out {
+				f.Close()
+			}
+		}
+	}()
+
+	var upscale string
+	for i := 0; i < n; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+		frame, err := extractFrame(img, i)
+		if err != nil {
+			return nil, "", fmt.Errorf("anim-failed; frame %d: %v", i, err)
+		}
+		frames = append(frames, frame)
+		if upscale, err = processImage(frame, source, params, overlay); err != nil {
+			return nil, "", err
+		}
+	}
+
+	first := frames[0]
+	for _, f := range frames[1:] {
+		if f.Width() != first.Width() || f.Height() != first.Height() {
+			log.Printf("Animation frames differ in size (%dx%d vs %dx%d), keeping the first frame",
+				first.Width(), first.Height(), f.Width(), f.Height())
+			out = first
+			return out, upscale, nil
+		}
+	}
+
+	frameH := first.Height()
+	err = first.ArrayJoin(frames[1:], 1)
+	if err == nil {
+		err = first.SetPageHeight(frameH)
+	}
+	if err == nil {
+		err = first.SetPages(n)
+	}
+	if err == nil && len(delay) == n {
+		err = first.SetPageDelay(delay)
+	}
+	if err == nil {
+		err = first.SetLoop(loop)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("anim-failed; %v", err)
+	}
+	out = first
+	return out, upscale, nil
+}
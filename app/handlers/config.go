@@ -97,11 +97,27 @@ type ConfigInfo struct {
 	MaxDBSizeMB    int                   `json:"max_db_size_mb"`
 	AVIFQuality    int                   `json:"avif_quality"`
 	MaxSize        int                   `json:"max_size"`
+	ClientHints    bool                  `json:"client_hints"`
+	QualityMin     int                   `json:"quality_min"`
+	QualityMax     int                   `json:"quality_max"`
+	AllowUpscale   bool                  `json:"allow_upscale"`
+	MaxUpscale     float64               `json:"max_upscale"`
 	DBSizeMB       float64               `json:"db_size_mb"`
 	DBSizeBytes    int64                 `json:"db_size_bytes"`
 	ImageCount     int                   `json:"image_count"`
 	DBSizeReadable string                `json:"db_size_readable"`
 	RefererStats   []database.DomainStat `json:"referer_stats"`
+	SigningMode    string                `json:"signing_mode"`
+	SigningKeySet  bool                  `json:"signing_key_set"`
+	Presets        []PresetInfo          `json:"presets"`
+	PresetsOnly    bool                  `json:"presets_only"`
+	Watermarks     []WatermarkInfo       `json:"watermarks"`
+	TextFont       string                `json:"text_font"`
+	JXLEnabled     bool                  `json:"jxl_enabled"`
+	JXLBeforeAVIF  bool                  `json:"jxl_before_avif"`
+	AnimatedAVIF   bool                  `json:"animated_avif"`
+	JPEGEncoding   string                `json:"jpeg_encoding"`
+	PNGEncoding    string                `json:"png_encoding"`
 	// Additional fields for template
 	SizeClass        string  `json:"-"`
 	ProgressClass    string  `json:"-"`
@@ -151,6 +167,7 @@ func ConfigHandler(w http.ResponseWriter, r *http.Request) {
 		refererStats = []database.DomainStat{}
 	}
 
+	jpegEncoding, pngEncoding := describeEncodeDefaults()
 	usagePercent := getUsagePercent(dbSizeMB, float64(database.MaxDatabaseSizeMB))
 
 	config := ConfigInfo{
@@ -158,11 +175,27 @@ func ConfigHandler(w http.ResponseWriter, r *http.Request) {
 		MaxDBSizeMB:      database.MaxDatabaseSizeMB,
 		AVIFQuality:      AVIFQuality,
 		MaxSize:          MaxSize,
+		ClientHints:      ClientHints,
+		QualityMin:       QualityMin,
+		QualityMax:       QualityMax,
+		AllowUpscale:     AllowUpscale,
+		MaxUpscale:       MaxUpscale,
 		DBSizeMB:         dbSizeMB,
 		DBSizeBytes:      dbSize,
 		ImageCount:       imageCount,
 		DBSizeReadable:   dbSizeReadable,
 		RefererStats:     refererStats,
+		SigningMode:      SigningMode,
+		SigningKeySet:    len(signingKey) > 0,
+		Presets:          ListPresets(),
+		PresetsOnly:      PresetsOnly,
+		Watermarks:       ListWatermarks(),
+		TextFont:         TextFont,
+		JXLEnabled:       JXLEnabled,
+		JXLBeforeAVIF:    JXLBeforeAVIF,
+		AnimatedAVIF:     AnimatedAVIF,
+		JPEGEncoding:     jpegEncoding,
+		PNGEncoding:      pngEncoding,
 		SizeClass:        getSizeClass(dbSizeMB, float64(database.MaxDatabaseSizeMB)),
 		ProgressClass:    getProgressClass(dbSizeMB, float64(database.MaxDatabaseSizeMB)),
 		UsagePercent:     usagePercent,
@@ -447,3 +480,44 @@ func ToggleDomainHandler(w http.ResponseWriter, r *http.Request) {
 		Success: true,
 	})
 }
+
+type SignURLRequest struct {
+	Params string `json:"params"`
+	Src    string `json:"src"`
+}
+
+type SignURLResponse struct {
+	Success bool   `json:"success"`
+	URL     string `json:"url,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// SignURLHandler returns a signed resize URL for the given params path and source URL
+func SignURLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 8192))
+	if err != nil {
+		json.NewEncoder(w).Encode(SignURLResponse{Success: false, Error: "Failed to read request body"})
+		return
+	}
+
+	var req SignURLRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		json.NewEncoder(w).Encode(SignURLResponse{Success: false, Error: "Invalid JSON"})
+		return
+	}
+
+	signed, err := SignURL(strings.TrimSpace(req.Params), strings.TrimSpace(req.Src))
+	if err != nil {
+		json.NewEncoder(w).Encode(SignURLResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(SignURLResponse{Success: true, URL: signed})
+}
@@ -0,0 +1,333 @@
+package handlers
+
+// Crop anchoring for c= (cover + crop) mode.
+//
+// By default the crop window is centered horizontally and sits 30% from the
+// top (faces and product tops tend to live there). g= picks a compass anchor
+// and fp=x,y (0..1 fractions of the image) centers the window on a focal
+// point, clamped so it never leaves the image.
+//
+// g=attention / g=entropy (crop=smart is an alias for attention) hand the
+// window placement to libvips' smart crop, which looks for skin tones,
+// saturated color and edges (attention) or the busiest region (entropy).
+//
+// rect=x,y,w,h (original image pixels) or rectp=x,y,w,h (percent of the
+// image) cut a region out of the source before anything else, e.g. an
+// editor-chosen crop. Sources are cached downscaled to MAX_SIZE, so pixel
+// rects are mapped through the original dimensions stored with the source.
+//
+// trim=1 (or trim=2..100, the color distance threshold, default 10) crops
+// uniform borders off the source after any rect=, e.g. the white margins of
+// supplier product photos. Sources with a transparent top-left corner trim
+// transparent borders; others trim borders in the top-left pixel's color, or
+// in trimcolor=hex when given.
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// gravityAnchors maps g= values to the relative crop window position
+// (0 = left/top edge, 1 = right/bottom edge).
+var gravityAnchors = map[string][2]float64{
+	"center": {0.5, 0.5},
+	"north":  {0.5, 0},
+	"south":  {0.5, 1},
+	"east":   {1, 0.5},
+	"west":   {0, 0.5},
+	"ne":     {1, 0},
+	"nw":     {0, 0},
+	"se":     {1, 1},
+	"sw":     {0, 1},
+}
+
+// gravityAliases are accepted spellings for the short compass names
+var gravityAliases = map[string]string{
+	"centre":    "center",
+	"northeast": "ne",
+	"northwest": "nw",
+	"southeast": "se",
+	"southwest": "sw",
+}
+
+// defaultCropAnchor keeps the original 70/30 vertical focus
+var defaultCropAnchor = [2]float64{0.5, 0.3}
+
+// smartGravities maps the content-aware g= values to libvips strategies
+var smartGravities = map[string]vips.Interesting{
+	"attention": vips.InterestingAttention,
+	"entropy":   vips.InterestingEntropy,
+}
+
+// parseGravity validates a g= value and returns its canonical name.
+func parseGravity(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if alias, ok := gravityAliases[s]; ok {
+		s = alias
+	}
+	if _, ok := smartGravities[s]; ok {
+		return s, nil
+	}
+	if _, ok := gravityAnchors[s]; !ok {
+		return "", fmt.Errorf("invalid g '%s', use center, north, south, east, west, ne, nw, se, sw, attention or entropy", s)
+	}
+	return s, nil
+}
+
+// smartCrop crops img to w x h with libvips' content-aware strategy when the
+// params ask for one. Returns false when the caller should place the window itself.
+func smartCrop(img *vips.ImageRef, w, h int, params *ResizeParams) (bool, error) {
+	interesting, ok := smartGravities[params.Gravity]
+	if !ok || params.HasFocal {
+		return false, nil
+	}
+	return true, img.SmartCrop(w, h, interesting)
+}
+
+// parseFocalPoint parses fp=x,y with both coordinates in 0..1. Values are
+// rounded to two decimals to keep cache variants bounded.
+func parseFocalPoint(s string) (float64, float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid fp '%s', use fp=x,y with 0..1 fractions", s)
+	}
+	var xy [2]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || !(f >= 0 && f <= 1) { // NaN fails too
+			return 0, 0, fmt.Errorf("invalid fp '%s', use fp=x,y with 0..1 fractions", s)
+		}
+		xy[i] = math.Round(f*100) / 100
+	}
+	return xy[0], xy[1], nil
+}
+
+// focalToken renders a focal point for cache keys, e.g. "fp0.42x0.61".
+func focalToken(x, y float64) string {
+	return "fp" + strconv.FormatFloat(x, 'f', -1, 64) + "x" + strconv.FormatFloat(y, 'f', -1, 64)
+}
+
+// cropOffset positions a w x h crop window inside a curW x curH image
+// according to the params' focal point, gravity, or the default anchor.
+func cropOffset(curW, curH, w, h int, params *ResizeParams) (int, int) {
+	var x, y int
+	if params.HasFocal {
+		x = int(math.Round(params.FocalX*float64(curW))) - w/2
+		y = int(math.Round(params.FocalY*float64(curH))) - h/2
+	} else {
+		anchor := defaultCropAnchor
+		if a, ok := gravityAnchors[params.Gravity]; ok {
+			anchor = a
+		}
+		x = int(float64(curW-w) * anchor[0])
+		y = int(float64(curH-h) * anchor[1])
+	}
+
+	if x > curW-w {
+		x = curW - w
+	}
+	if y > curH-h {
+		y = curH - h
+	}
+	if x < 0 {
+		x = 0
+	}
+	if y < 0 {
+		y = 0
+	}
+	return x, y
+}
+
+// CropOffsetForTest exposes cropOffset for tests
+func CropOffsetForTest(curW, curH, w, h int, gravity string, fx, fy float64, hasFocal bool) (int, int) {
+	return cropOffset(curW, curH, w, h, &ResizeParams{Gravity: gravity, FocalX: fx, FocalY: fy, HasFocal: hasFocal})
+}
+
+// parseRect parses rect= (whole source pixels) or rectp= (percent, two
+// decimals) into params, with a "rect10x20x300x200" / "rectp..." cache key token.
+func parseRect(q url.Values, params *ResizeParams) error {
+	rect, rectp := q.Get("rect"), q.Get("rectp")
+	if rect == "" && rectp == "" {
+		return nil
+	}
+	if rect != "" && rectp != "" {
+		return fmt.Errorf("use either rect or rectp, not both")
+	}
+	s, name, percent := rect, "rect", false
+	if rectp != "" {
+		s, name, percent = rectp, "rectp", true
+	}
+
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return fmt.Errorf("invalid %s '%s', use %s=x,y,w,h", name, s, name)
+	}
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || !(f >= 0) || math.IsInf(f, 0) { // NaN fails too
+			return fmt.Errorf("invalid %s '%s', use %s=x,y,w,h", name, s, name)
+		}
+		if percent {
+			f = math.Round(f*100) / 100
+		} else if f != math.Trunc(f) {
+			return fmt.Errorf("invalid rect '%s', use whole pixels", s)
+		}
+		v[i] = f
+	}
+	if v[2] == 0 || v[3] == 0 {
+		return fmt.Errorf("%s needs a non-empty width and height", name)
+	}
+	if percent && (v[0]+v[2] > 100 || v[1]+v[3] > 100) {
+		return fmt.Errorf("rectp must stay within 0..100")
+	}
+
+	params.Rect, params.RectPercent, params.HasRect = v, percent, true
+	token := name
+	for i, f := range v {
+		if i > 0 {
+			token += "x"
+		}
+		token += strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	params.appendCacheKey(token)
+	return nil
+}
+
+// extractRect cuts the params' rect out of img. Pixel rects refer to the
+// origW x origH original and are scaled onto the cached (possibly downscaled)
+// source; with unknown original dimensions (0) the cached size is used.
+// Rects reaching past the edge are clipped. Modifies in place.
+func extractRect(img *vips.ImageRef, origW, origH int, params *ResizeParams) error {
+	if !params.HasRect {
+		return nil
+	}
+	curW, curH := img.Width(), img.Height()
+
+	var sx, sy float64
+	if params.RectPercent {
+		sx, sy = float64(curW)/100, float64(curH)/100
+	} else {
+		if origW <= 0 || origH <= 0 {
+			origW, origH = curW, curH
+		}
+		sx, sy = float64(curW)/float64(origW), float64(curH)/float64(origH)
+	}
+
+	r := params.Rect
+	x := int(math.Round(r[0] * sx))
+	y := int(math.Round(r[1] * sy))
+	if x >= curW || y >= curH {
+		return fmt.Errorf("rect starts outside the %dx%d image", int(float64(curW)/sx), int(float64(curH)/sy))
+	}
+	w := max(minInt(int(math.Round(r[2]*sx)), curW-x), 1)
+	h := max(minInt(int(math.Round(r[3]*sy)), curH-y), 1)
+	return img.ExtractArea(x, y, w, h)
+}
+
+// defaultTrimThreshold is the trim=1 (and STEP render) color distance threshold
+const defaultTrimThreshold = 10
+
+// parseTrim parses trim= and trimcolor= into params and their cache key
+// token ("trim10", "trim25-ffffff").
+func parseTrim(q url.Values, params *ResizeParams) error {
+	s := q.Get("trim")
+	switch s {
+	case "", "0", "false":
+		if q.Get("trimcolor") != "" {
+			return fmt.Errorf("trimcolor needs trim=")
+		}
+		return nil
+	case "1", "true":
+		params.Trim = defaultTrimThreshold
+	default:
+		threshold, err := strconv.Atoi(s)
+		if err != nil || threshold < 2 || threshold > 100 {
+			return fmt.Errorf("invalid trim '%s', use trim=1 or a threshold trim=2..100", s)
+		}
+		params.Trim = threshold
+	}
+
+	token := "trim" + strconv.Itoa(params.Trim)
+	if c := q.Get("trimcolor"); c != "" {
+		hexColor, ok := parseHexColor(c)
+		if !ok {
+			return fmt.Errorf("invalid trimcolor '%s', use a hex color", c)
+		}
+		params.TrimColor = hexColor
+		token += "-" + hexColor
+	}
+	params.appendCacheKey(token)
+	return nil
+}
+
+// applyTrim crops uniform borders per trim=. Without trimcolor= the border
+// color is taken from the top-left pixel; a transparent one trims on alpha.
+// Modifies in place.
+func applyTrim(img *vips.ImageRef, params *ResizeParams) error {
+	if params.Trim == 0 {
+		return nil
+	}
+	threshold := float64(params.Trim)
+	if params.TrimColor != "" {
+		c := bgColor(params.TrimColor)
+		return trimBorders(img, threshold, &c)
+	}
+
+	// GetPoint reads RGB(A); sample grayscale sources through an sRGB copy
+	probe := img
+	if img.Bands() < 3 {
+		srgb, err := img.Copy()
+		if err != nil {
+			return err
+		}
+		defer srgb.Close()
+		if err := srgb.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+		probe = srgb
+	}
+	corner, err := probe.GetPoint(0, 0)
+	if err != nil {
+		return err
+	}
+	if len(corner) == 4 && corner[3] < 128 {
+		return trimBorders(img, threshold, nil)
+	}
+	return trimBorders(img, threshold, &vips.Color{
+		R: uint8(math.Round(corner[0])), G: uint8(math.Round(corner[1])), B: uint8(math.Round(corner[2])),
+	})
+}
+
+// trimBorders crops borders within threshold of color c, or transparent
+// borders (on the alpha channel) when c is nil. Images that are all border
+// are left as they are. Modifies in place.
+func trimBorders(img *vips.ImageRef, threshold float64, c *vips.Color) error {
+	var left, top, tw, th int
+	var err error
+	if c == nil {
+		if !img.HasAlpha() {
+			return nil
+		}
+		alpha, aerr := img.ExtractBandToImage(img.Bands()-1, 1)
+		if aerr != nil {
+			return aerr
+		}
+		defer alpha.Close()
+		left, top, tw, th, err = alpha.FindTrim(threshold, &vips.Color{R: 0, G: 0, B: 0})
+	} else {
+		left, top, tw, th, err = img.FindTrim(threshold, c)
+	}
+	if err != nil {
+		return err
+	}
+	if tw > 0 && th > 0 && (tw < img.Width() || th < img.Height()) {
+		return img.ExtractArea(left, top, tw, th)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package handlers
+
+// JPEG and PNG encoder settings.
+//
+// Server defaults come from the environment, per-request params override them:
+//
+//   interlace=0|1              JPEG_INTERLACE   progressive JPEG, default on
+//   optimize=0|1               JPEG_OPTIMIZE    optimized Huffman coding
+//   trellis=0|1                JPEG_TRELLIS     trellis quantisation (mozjpeg builds)
+//   subsample=auto|420|444     JPEG_SUBSAMPLE   chroma subsampling, default auto
+//   pngcomp=0..9               PNG_COMPRESSION  zlib level, default 6
+//   pngfilter=none|sub|up|avg|paeth|all
+//                              PNG_FILTER       row filter, default none
+//
+// They only change JPEG and PNG output (the fallback for clients without
+// AVIF/WebP, and forced formats). Per-request values land in the cache key
+// ("interlace0", "pngfilter-paeth"); the server defaults don't, so clear the
+// cache after changing them.
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// JPEGOptions are the JPEG encoder settings
+type JPEGOptions struct {
+	Interlace bool               // progressive
+	Optimize  bool               // optimized Huffman coding
+	Trellis   bool               // trellis quantisation
+	Subsample vips.SubsampleMode // chroma subsampling
+}
+
+// PNGOptions are the PNG encoder settings
+type PNGOptions struct {
+	Compression int // zlib level 0..9
+	Filter      vips.PngFilter
+}
+
+// JPEGDefaults are the server JPEG settings (JPEG_* env)
+var JPEGDefaults = JPEGOptions{Interlace: true, Subsample: vips.VipsForeignSubsampleAuto}
+
+// PNGDefaults are the server PNG settings (PNG_* env)
+var PNGDefaults = PNGOptions{Compression: 6, Filter: vips.PngFilterNone}
+
+// subsampleModes maps subsample= and JPEG_SUBSAMPLE values to vips modes
+var subsampleModes = map[string]vips.SubsampleMode{
+	"auto": vips.VipsForeignSubsampleAuto,
+	"420":  vips.VipsForeignSubsampleOn,
+	"444":  vips.VipsForeignSubsampleOff,
+}
+
+// pngFilters maps pngfilter= and PNG_FILTER values to vips filters
+var pngFilters = map[string]vips.PngFilter{
+	"none":  vips.PngFilterNone,
+	"sub":   vips.PngFilterSub,
+	"up":    vips.PngFilterUo,
+	"avg":   vips.PngFilterAvg,
+	"paeth": vips.PngFilterPaeth,
+	"all":   vips.PngFilterAll,
+}
+
+// InitEncodeOptions reads the JPEG_* and PNG_* encoder defaults from
+// environment. Must be called after godotenv.Load() and before presets are
+// loaded.
+func InitEncodeOptions() {
+	for _, b := range []struct {
+		env string
+		dst *bool
+	}{
+		{"JPEG_INTERLACE", &JPEGDefaults.Interlace},
+		{"JPEG_OPTIMIZE", &JPEGDefaults.Optimize},
+		{"JPEG_TRELLIS", &JPEGDefaults.Trellis},
+	} {
+		switch v := strings.ToLower(os.Getenv(b.env)); v {
+		case "":
+		case "true", "1":
+			*b.dst = true
+		case "false", "0":
+			*b.dst = false
+		default:
+			log.Printf("Invalid %s value '%s', use true or false; keeping %t", b.env, v, *b.dst)
+		}
+	}
+	if v := os.Getenv("JPEG_SUBSAMPLE"); v != "" {
+		if mode, ok := subsampleModes[strings.ToLower(v)]; ok {
+			JPEGDefaults.Subsample = mode
+		} else {
+			log.Printf("Invalid JPEG_SUBSAMPLE value '%s', use auto, 420 or 444; using auto", v)
+		}
+	}
+	if v := os.Getenv("PNG_COMPRESSION"); v != "" {
+		level, err := strconv.Atoi(v)
+		if err != nil || level < 0 || level > 9 {
+			log.Printf("Invalid PNG_COMPRESSION value '%s', must be 0-9, using default 6", v)
+		} else {
+			PNGDefaults.Compression = level
+		}
+	}
+	if v := os.Getenv("PNG_FILTER"); v != "" {
+		if filter, ok := pngFilters[strings.ToLower(v)]; ok {
+			PNGDefaults.Filter = filter
+		} else {
+			log.Printf("Invalid PNG_FILTER value '%s', use none, sub, up, avg, paeth or all; using none", v)
+		}
+	}
+	log.Printf("JPEG encoding: interlace=%t optimize=%t trellis=%t; PNG compression %d",
+		JPEGDefaults.Interlace, JPEGDefaults.Optimize, JPEGDefaults.Trellis, PNGDefaults.Compression)
+}
+
+// parseEncodeOptions parses the JPEG and PNG encoder params into params, each
+// given one adding its cache key token ("optimize1", "subsample444", ...).
+func parseEncodeOptions(q url.Values, params *ResizeParams) error {
+	jpeg := JPEGDefaults
+	jpegSet := false
+	for _, b := range []struct {
+		key string
+		dst *bool
+	}{
+		{"interlace", &jpeg.Interlace},
+		{"optimize", &jpeg.Optimize},
+		{"trellis", &jpeg.Trellis},
+	} {
+		switch v := q.Get(b.key); v {
+		case "":
+			continue
+		case "1", "true":
+			*b.dst = true
+			params.appendCacheKey(b.key + "1")
+		case "0", "false":
+			*b.dst = false
+			params.appendCacheKey(b.key + "0")
+		default:
+			return fmt.Errorf("invalid %s, use %s=0 or %s=1", b.key, b.key, b.key)
+		}
+		jpegSet = true
+	}
+	if v := q.Get("subsample"); v != "" {
+		mode, ok := subsampleModes[v]
+		if !ok {
+			return fmt.Errorf("invalid subsample, use subsample=auto, 420 or 444")
+		}
+		jpeg.Subsample = mode
+		jpegSet = true
+		params.appendCacheKey("subsample" + v)
+	}
+	if jpegSet {
+		params.JPEG = &jpeg
+	}
+
+	png := PNGDefaults
+	pngSet := false
+	if v := q.Get("pngcomp"); v != "" {
+		level, err := strconv.Atoi(v)
+		if err != nil || level < 0 || level > 9 {
+			return fmt.Errorf("invalid pngcomp, use pngcomp=0..9")
+		}
+		png.Compression = level
+		pngSet = true
+		params.appendCacheKey("pngcomp" + v)
+	}
+	if v := q.Get("pngfilter"); v != "" {
+		filter, ok := pngFilters[v]
+		if !ok {
+			return fmt.Errorf("invalid pngfilter, use none, sub, up, avg, paeth or all")
+		}
+		png.Filter = filter
+		pngSet = true
+		params.appendCacheKey("pngfilter-" + v)
+	}
+	if pngSet {
+		params.PNG = &png
+	}
+	return nil
+}
+
+// jpegOptions returns the request's JPEG settings, the server defaults
+// unless overridden.
+func (p *ResizeParams) jpegOptions() JPEGOptions {
+	if p.JPEG != nil {
+		return *p.JPEG
+	}
+	return JPEGDefaults
+}
+
+// pngOptions returns the request's PNG settings, the server defaults unless
+// overridden.
+func (p *ResizeParams) pngOptions() PNGOptions {
+	if p.PNG != nil {
+		return *p.PNG
+	}
+	return PNGDefaults
+}
+
+// describeEncodeDefaults summarizes the server JPEG and PNG settings for the
+// admin dashboard.
+func describeEncodeDefaults() (jpeg, png string) {
+	parts := []string{"baseline"}
+	if JPEGDefaults.Interlace {
+		parts[0] = "progressive"
+	}
+	if JPEGDefaults.Optimize {
+		parts = append(parts, "optimized coding")
+	}
+	if JPEGDefaults.Trellis {
+		parts = append(parts, "trellis")
+	}
+	for name, mode := range subsampleModes {
+		if mode == JPEGDefaults.Subsample {
+			parts = append(parts, "subsampling "+name)
+		}
+	}
+	jpeg = strings.Join(parts, ", ")
+
+	png = fmt.Sprintf("compression %d", PNGDefaults.Compression)
+	for name, filter := range pngFilters {
+		if filter == PNGDefaults.Filter {
+			png += ", filter " + name
+		}
+	}
+	return jpeg, png
+}
@@ -0,0 +1,184 @@
+package handlers
+
+// Explicit fit modes (fit=) for w=WxH sizes.
+//
+//   cover   - same as c=WxH: scale to cover, then crop
+//   inside  - same as w=WxH: scale to fit inside, aspect kept (the default)
+//   pad     - fit inside, then letterbox onto an exact WxH canvas filled with
+//             bg= (transparent by default, or a hex color); "contain" is an alias
+//   fill    - stretch to WxH, ignoring aspect ratio; an axis that would grow
+//             stays at its original size without up=1
+//   outside - scale to cover WxH without cropping (one side may overshoot)
+//
+// pad, fill and outside need both dimensions. g= positions the image on the
+// pad canvas (center by default). Like the other modes, nothing is enlarged
+// beyond the original without up=1; pad still emits the full canvas around a
+// small image.
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// fitAliases maps accepted fit= spellings onto canonical modes
+var fitAliases = map[string]string{
+	"contain": "pad",
+}
+
+// parseFit applies fit= to params after the size params are parsed: cover and
+// inside are canonicalized onto the existing c_/w_ keys (so fit=cover shares
+// cache entries with c=WxH), the rest set params.Fit and add a cache key token.
+func parseFit(s string, params *ResizeParams) error {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if alias, ok := fitAliases[s]; ok {
+		s = alias
+	}
+	if s == "" {
+		return nil
+	}
+	if params.CropMode {
+		return fmt.Errorf("fit can't be combined with c=, use w=WxH&fit=%s", s)
+	}
+
+	switch s {
+	case "inside":
+		return nil
+	case "cover", "pad", "fill", "outside":
+	default:
+		return fmt.Errorf("invalid fit '%s', use cover, inside, pad, fill or outside", s)
+	}
+
+	if params.Width == 0 || params.Height == 0 {
+		return fmt.Errorf("fit=%s needs both dimensions, use w=WxH", s)
+	}
+
+	switch s {
+	case "cover":
+		params.CropMode = true
+		params.CacheKey = fmt.Sprintf("c_%dx%d", params.Width, params.Height)
+	case "pad":
+		params.Fit = s
+		params.appendCacheKey("pad-" + params.BgKey)
+	default:
+		params.Fit = s
+		params.appendCacheKey(s)
+	}
+	return nil
+}
+
+// bgColor resolves a parseBg key ("white" or 6-digit hex) to an RGB color.
+// "transparent" resolves to white for callers that need an opaque fallback.
+func bgColor(key string) vips.Color {
+	if len(key) != 6 {
+		return vips.Color{R: 255, G: 255, B: 255}
+	}
+	v, err := strconv.ParseUint(key, 16, 32)
+	if err != nil {
+		return vips.Color{R: 255, G: 255, B: 255}
+	}
+	return vips.Color{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v)}
+}
+
+// fitImage resizes img into a targetWidth x targetHeight box with the explicit
+// fit mode in params.Fit. Modifies in place and returns the upscale state like
+// resizeImage.
+func fitImage(img *vips.ImageRef, targetWidth, targetHeight int, sizeClamped bool, params *ResizeParams) (string, error) {
+	origW := img.Width()
+	origH := img.Height()
+	scaleX := float64(targetWidth) / float64(origW)
+	scaleY := float64(targetHeight) / float64(origH)
+
+	switch params.Fit {
+	case "fill":
+		if scaleX >= 1 && scaleY >= 1 && !params.Upscale {
+			return upscaleUnchanged, nil
+		}
+		state := ""
+		if !params.Upscale && (scaleX > 1 || scaleY > 1) {
+			// Shrink the other axis only, keeping the growing one at its original size
+			scaleX, scaleY = math.Min(scaleX, 1), math.Min(scaleY, 1)
+			state = upscaleUnchanged
+		}
+		// Cap the larger axis and keep the stretch ratio
+		if params.Upscale {
+			larger := math.Max(scaleX, scaleY)
+			var capped float64
+			capped, state = capUpscale(larger, sizeClamped)
+			scaleX, scaleY = scaleX*capped/larger, scaleY*capped/larger
+		}
+		return state, img.ResizeWithVScale(scaleX, scaleY, vips.KernelLanczos3)
+
+	case "outside":
+		scale := math.Max(scaleX, scaleY)
+		if scale >= 1 && !params.Upscale {
+			return upscaleUnchanged, nil
+		}
+		state := ""
+		if params.Upscale {
+			scale, state = capUpscale(scale, sizeClamped)
+			scale, state = capToMaxSize(scale, origW, origH, state)
+		}
+		return state, img.Resize(scale, vips.KernelLanczos3)
+
+	case "pad":
+		scale := math.Min(scaleX, scaleY)
+		state := ""
+		switch {
+		case params.Upscale:
+			scale, state = capUpscale(scale, sizeClamped)
+		case scale >= 1:
+			scale, state = 1, upscaleUnchanged
+		}
+		if scale != 1 {
+			if err := img.Resize(scale, vips.KernelLanczos3); err != nil {
+				return "", err
+			}
+		}
+		return state, padImage(img, targetWidth, targetHeight, params)
+	}
+	return "", fmt.Errorf("unknown fit mode '%s'", params.Fit)
+}
+
+// padImage embeds img onto a w x h canvas filled with the params' background,
+// positioned by g= (centered by default).
+func padImage(img *vips.ImageRef, w, h int, params *ResizeParams) error {
+	// Rounding in the resize can overshoot the box by a pixel
+	if img.Width() > w || img.Height() > h {
+		if err := img.ExtractArea(0, 0, minInt(img.Width(), w), minInt(img.Height(), h)); err != nil {
+			return err
+		}
+	}
+
+	// Grayscale sources get RGB bands so the fill color survives
+	if img.Bands() < 3 {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+
+	bg := &vips.ColorRGBA{A: 255}
+	if params.BgTransparent {
+		bg.A = 0
+		if !img.HasAlpha() {
+			if err := img.AddAlpha(); err != nil {
+				return err
+			}
+		}
+	} else {
+		c := bgColor(params.BgKey)
+		bg.R, bg.G, bg.B = c.R, c.G, c.B
+	}
+
+	anchor := [2]float64{0.5, 0.5}
+	if a, ok := gravityAnchors[params.Gravity]; ok {
+		anchor = a
+	}
+	x := int(float64(w-img.Width()) * anchor[0])
+	y := int(float64(h-img.Height()) * anchor[1])
+
+	return img.EmbedBackgroundRGBA(x, y, w, h, bg)
+}
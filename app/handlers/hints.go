@@ -0,0 +1,160 @@
+package handlers
+
+// HTTP Client Hints.
+//
+// Resize responses advertise Accept-CH so Chromium browsers send Sec-CH-DPR,
+// Sec-CH-Width and Sec-CH-Viewport-Width on later image requests (a page on
+// another origin has to delegate them, e.g. with
+// <meta http-equiv="Delegate-CH" content="sec-ch-dpr https://img.example.com; ...">).
+// Save-Data needs no opt-in. Hints only fill in what the URL leaves out:
+//
+//   w=auto  - w= from Sec-CH-Width (device px), or Sec-CH-Viewport-Width
+//             plus dpr= from Sec-CH-DPR; rounded up to a width bucket. The
+//             original size without hints. URLs without a size keep it.
+//   no dpr= - dpr= from Sec-CH-DPR, rounded to 0.5 steps (sized URLs)
+//   no q=   - q=50 when Save-Data: on
+//
+// Hinted values go through the regular parser, so they land in the cache key
+// like explicit ones and bucketing keeps the variant count bounded. Signatures
+// are checked against the URL as minted, before hints apply.
+//
+// Off by default so existing URLs keep their output and Vary on upgrade;
+// CLIENT_HINTS=true turns hints on.
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ClientHints enables Accept-CH and hint-derived params (CLIENT_HINTS)
+var ClientHints = false
+
+// acceptCH lists the hints advertised via Accept-CH
+const acceptCH = "Sec-CH-DPR, Sec-CH-Width, Sec-CH-Viewport-Width"
+
+// saveDataQuality is the q= applied for Save-Data: on (still clamped to
+// QUALITY_MIN/QUALITY_MAX)
+const saveDataQuality = 50
+
+// hintWidthBuckets are the widths hinted sizes round up to
+var hintWidthBuckets = []int{160, 320, 480, 640, 768, 960, 1080, 1280, 1440, 1600, 1920, 2560, 3840}
+
+// InitClientHints reads CLIENT_HINTS from environment. Must be called after
+// godotenv.Load().
+func InitClientHints() {
+	v := strings.ToLower(os.Getenv("CLIENT_HINTS"))
+	ClientHints = v == "true" || v == "1"
+	if ClientHints {
+		log.Println("Client hints enabled")
+	}
+}
+
+// bucketWidth rounds a hinted width up to the next bucket, capped at MaxSize.
+func bucketWidth(w int) int {
+	for _, b := range hintWidthBuckets {
+		if b >= w {
+			w = b
+			break
+		}
+	}
+	if w > MaxSize {
+		return MaxSize
+	}
+	return w
+}
+
+// hintNumber parses a positive numeric hint header, 0 when absent or invalid.
+func hintNumber(r *http.Request, name string) float64 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(r.Header.Get(name)), 64)
+	if err != nil || !(v > 0) || math.IsInf(v, 0) { // NaN fails too
+		return 0
+	}
+	return v
+}
+
+// hintDPR returns Sec-CH-DPR rounded to 0.5 steps within the dpr= range,
+// 0 when absent or 1.
+func hintDPR(r *http.Request) float64 {
+	dpr := math.Round(hintNumber(r, "Sec-CH-DPR")*2) / 2
+	if dpr <= 1 {
+		return 0
+	}
+	return math.Min(dpr, 4)
+}
+
+// clientHintValues derives hinted values from the resolved request values.
+// Returns the hinted values (nil when no hint applies) and the hint headers
+// the response varies on - every hint that could have applied, sent or not.
+func clientHintValues(r *http.Request, q url.Values, params *ResizeParams) (url.Values, []string) {
+	hinted := url.Values{}
+	for k, v := range q {
+		hinted[k] = v
+	}
+	var vary []string
+	changed := false
+	dpr := hintDPR(r)
+
+	// Width hints only where the URL asks for them (w=auto); they would mint
+	// variants PRESETS_ONLY is meant to prevent
+	if params.AutoWidth && params.Height == 0 && !PresetsOnly {
+		vary = append(vary, "Sec-CH-Width", "Sec-CH-Viewport-Width", "Sec-CH-DPR")
+		if w := hintNumber(r, "Sec-CH-Width"); w > 0 {
+			hinted.Set("w", strconv.Itoa(bucketWidth(int(math.Ceil(w)))))
+			changed = true
+		} else if vw := hintNumber(r, "Sec-CH-Viewport-Width"); vw > 0 {
+			hinted.Set("w", strconv.Itoa(bucketWidth(int(math.Ceil(vw)))))
+			if dpr > 0 && q.Get("dpr") == "" {
+				hinted.Set("dpr", strconv.FormatFloat(dpr, 'f', -1, 64))
+			}
+			changed = true
+		}
+	} else if (params.Width > 0 || params.Height > 0) && q.Get("dpr") == "" {
+		vary = append(vary, "Sec-CH-DPR")
+		if dpr > 0 {
+			hinted.Set("dpr", strconv.FormatFloat(dpr, 'f', -1, 64))
+			changed = true
+		}
+	}
+
+	if q.Get("q") == "" {
+		vary = append(vary, "Save-Data")
+		if strings.EqualFold(strings.TrimSpace(r.Header.Get("Save-Data")), "on") {
+			hinted.Set("q", strconv.Itoa(saveDataQuality))
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil, vary
+	}
+	return hinted, vary
+}
+
+// applyClientHints returns params with client hints applied, and the hint
+// headers to add to Vary. Hinted values that don't parse leave params as is.
+func applyClientHints(r *http.Request, q url.Values, params *ResizeParams) (*ResizeParams, []string) {
+	if !ClientHints {
+		return params, nil
+	}
+	hinted, vary := clientHintValues(r, q, params)
+	if hinted == nil {
+		return params, vary
+	}
+	hintedParams, err := parseResizeValues(hinted)
+	if err != nil {
+		log.Printf("Ignoring client hints (%v)", err)
+		return params, vary
+	}
+	hintedParams.Format = params.Format // a path extension overrides f=
+	return hintedParams, vary
+}
+
+// SetClientHintsForTest enables or disables client hints for tests
+func SetClientHintsForTest(enabled bool) {
+	ClientHints = enabled
+}
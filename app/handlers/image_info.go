@@ -2,11 +2,15 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
 
 	"image-resize/app/models"
+
+	"github.com/davidbyttow/govips/v2/vips"
 )
 
 func ImageInfoHandler(w http.ResponseWriter, r *http.Request) {
@@ -30,7 +34,7 @@ func ImageInfoHandler(w http.ResponseWriter, r *http.Request) {
 	// Restrict to static/ directory only
 	safePath := filepath.Join("static", cleanPath)
 
-	img, err := models.NewImage(safePath)
+	img, err := imageInfo(safePath)
 	if err != nil {
 		http.Error(w, "Failed to read image: "+err.Error(), http.StatusBadRequest)
 		return
@@ -39,3 +43,35 @@ func ImageInfoHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(img.GetProperties())
 }
+
+// imageInfo reads a local image's properties. PDF and TIFF documents, which
+// the Go image decoders don't handle, are read with libvips for the page count.
+func imageInfo(path string) (*models.Image, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".pdf", ".tif", ".tiff":
+	default:
+		return models.NewImage(path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := formatName(vips.DetermineImageType(data))
+	if !isDocument(format) {
+		return nil, fmt.Errorf("not a PDF or TIFF document")
+	}
+	img, pages, err := loadDocumentPage(data, format, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	return &models.Image{
+		Source:   path,
+		Width:    img.Width(),
+		Height:   img.Height(),
+		Format:   format,
+		FileSize: int64(len(data)),
+		Pages:    pages,
+	}, nil
+}
@@ -0,0 +1,94 @@
+package handlers
+
+// JPEG XL output.
+//
+// JXL is negotiated like AVIF and WebP (Accept: image/jxl, sent by Safari)
+// and can be forced with .jxl / f=jxl. libvips is often built without
+// libjxl, so the encoder is probed at startup; without it JXL is never
+// negotiated and forcing it is a 400. JXL_PRIORITY places it relative to
+// AVIF for clients accepting both: "before-avif" (default) or "after-avif".
+// Animations are served as AVIF/WebP/GIF, never JXL.
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// JXLEnabled reports whether libvips can encode JPEG XL (probed by InitJXL)
+var JXLEnabled bool
+
+// JXLBeforeAVIF negotiates JXL ahead of AVIF (JXL_PRIORITY=before-avif)
+var JXLBeforeAVIF = true
+
+// jxlFormat is the negotiableFormats entry for JPEG XL
+var jxlFormat = struct {
+	name string
+	mime string
+}{"jxl", "image/jxl"}
+
+// InitJXL reads JXL_PRIORITY and probes the libvips JXL encoder. Must be
+// called after godotenv.Load() and vips.Startup().
+func InitJXL() {
+	switch p := strings.ToLower(strings.TrimSpace(os.Getenv("JXL_PRIORITY"))); p {
+	case "", "before-avif":
+	case "after-avif":
+		JXLBeforeAVIF = false
+	default:
+		log.Printf("Invalid JXL_PRIORITY '%s', use before-avif or after-avif; using before-avif", p)
+	}
+
+	enabled := probeJXL()
+	setJXL(enabled, JXLBeforeAVIF)
+	if !enabled {
+		log.Printf("JPEG XL output disabled: libvips has no JXL encoder")
+		return
+	}
+	order := "after AVIF"
+	if JXLBeforeAVIF {
+		order = "before AVIF"
+	}
+	log.Printf("JPEG XL output enabled, negotiated %s", order)
+}
+
+// probeJXL encodes a tiny image to check the JXL encoder is available
+func probeJXL() bool {
+	if !vips.IsTypeSupported(vips.ImageTypeJXL) {
+		return false
+	}
+	img, err := vips.Black(8, 8)
+	if err != nil {
+		return false
+	}
+	defer img.Close()
+	_, err = encodeJXL(img, 50)
+	return err == nil
+}
+
+// setJXL enables or disables JXL output and places it in negotiableFormats
+// before or after AVIF.
+func setJXL(enabled, beforeAVIF bool) {
+	JXLEnabled, JXLBeforeAVIF = enabled, beforeAVIF
+
+	formats := negotiableFormats[:0:0]
+	for _, f := range negotiableFormats {
+		if f.name == jxlFormat.name {
+			continue
+		}
+		if enabled && beforeAVIF && f.name == "avif" {
+			formats = append(formats, jxlFormat)
+		}
+		formats = append(formats, f)
+		if enabled && !beforeAVIF && f.name == "avif" {
+			formats = append(formats, jxlFormat)
+		}
+	}
+	negotiableFormats = formats
+}
+
+// SetJXLForTest overrides the probed JXL support for tests
+func SetJXLForTest(enabled, beforeAVIF bool) {
+	setJXL(enabled, beforeAVIF)
+}
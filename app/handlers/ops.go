@@ -0,0 +1,305 @@
+package handlers
+
+// Image operations beyond resizing.
+//
+//   rot=90|180|270  - rotate clockwise (any multiple of 90, rot=-90 = rot=270)
+//   flip=h|v|hv     - mirror horizontally / vertically, after rotation
+//   bri=-100..100   - brightness, percent change of lightness
+//   con=-100..100   - contrast, percent stretch of lightness around mid-gray
+//   sat=-100..100   - saturation, percent change of chroma (-100 = no color)
+//   gray=1          - grayscale
+//   sepia=1         - sepia tone
+//   tint=hex        - monochrome in a tint color (white maps to the tint)
+//   blur=0.5..50    - Gaussian blur, sigma in output pixels
+//   sharpen=0.5..10 - unsharp mask strength (~2 is mild, for soft downscales)
+//
+// Rotation and flips run before the resize, so w=/h=/c= and g= refer to the
+// rotated image. EXIF orientation is already applied when the source is
+// cached (fetchSourceRemote), so rot= is relative to the upright image.
+// Blur, then sharpen, then the color operations run on the resized image,
+// bri/con/sat first; gray, sepia and tint are exclusive.
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// rotateAngles maps rot= degrees onto vips angles
+var rotateAngles = map[int]vips.Angle{
+	90:  vips.Angle90,
+	180: vips.Angle180,
+	270: vips.Angle270,
+}
+
+// parseOrientation parses rot= and flip= into params and their cache key
+// tokens ("rot90", "flip-h"). flip=hv is the same as rot=180 and is folded
+// into Rotate so both share a cache entry.
+func parseOrientation(q url.Values, params *ResizeParams) error {
+	if s := q.Get("rot"); s != "" {
+		deg, err := strconv.Atoi(s)
+		if err != nil || deg%90 != 0 {
+			return fmt.Errorf("invalid rot '%s', use rot=90, 180 or 270", s)
+		}
+		params.Rotate = (deg%360 + 360) % 360
+	}
+
+	switch strings.ToLower(q.Get("flip")) {
+	case "":
+	case "h":
+		params.Flip = "h"
+	case "v":
+		params.Flip = "v"
+	case "hv", "vh", "both":
+		params.Rotate = (params.Rotate + 180) % 360
+	default:
+		return fmt.Errorf("invalid flip '%s', use flip=h or flip=v", q.Get("flip"))
+	}
+
+	if params.Rotate != 0 {
+		params.appendCacheKey("rot" + strconv.Itoa(params.Rotate))
+	}
+	if params.Flip != "" {
+		params.appendCacheKey("flip-" + params.Flip)
+	}
+	return nil
+}
+
+// applyOrientation rotates and flips img per rot=/flip=. Modifies in place.
+func applyOrientation(img *vips.ImageRef, params *ResizeParams) error {
+	if angle, ok := rotateAngles[params.Rotate]; ok {
+		if err := img.Rotate(angle); err != nil {
+			return err
+		}
+	}
+	switch params.Flip {
+	case "h":
+		return img.Flip(vips.DirectionHorizontal)
+	case "v":
+		return img.Flip(vips.DirectionVertical)
+	}
+	return nil
+}
+
+// sepiaMatrix is the usual sepia tone recombination
+var sepiaMatrix = [3][3]float64{
+	{0.393, 0.769, 0.189},
+	{0.349, 0.686, 0.168},
+	{0.272, 0.534, 0.131},
+}
+
+// lumaWeights are the Rec. 709 luma coefficients
+var lumaWeights = [3]float64{0.2126, 0.7152, 0.0722}
+
+// parseFlag parses an on/off param ("1"/"true", "0"/"false" or empty).
+func parseFlag(q url.Values, key string) (bool, error) {
+	switch q.Get(key) {
+	case "", "0", "false":
+		return false, nil
+	case "1", "true":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid %s, use %s=1", key, key)
+}
+
+// parsePercent parses a -100..100 adjustment param, 0 when absent.
+func parsePercent(q url.Values, key string) (int, error) {
+	s := q.Get(key)
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < -100 || v > 100 {
+		return 0, fmt.Errorf("invalid %s, use %s=-100..100", key, key)
+	}
+	return v, nil
+}
+
+// parseColorOps parses bri=, con=, sat=, gray=, sepia= and tint= into params
+// and their cache key tokens ("bri20", "sat-100", "gray", "tint-0066cc").
+func parseColorOps(q url.Values, params *ResizeParams) error {
+	var err error
+	if params.Brightness, err = parsePercent(q, "bri"); err != nil {
+		return err
+	}
+	if params.Contrast, err = parsePercent(q, "con"); err != nil {
+		return err
+	}
+	if params.Saturation, err = parsePercent(q, "sat"); err != nil {
+		return err
+	}
+	if params.Gray, err = parseFlag(q, "gray"); err != nil {
+		return err
+	}
+	if params.Sepia, err = parseFlag(q, "sepia"); err != nil {
+		return err
+	}
+	if t := q.Get("tint"); t != "" {
+		hex, ok := parseHexColor(t)
+		if !ok {
+			return fmt.Errorf("invalid tint '%s', use a hex color", t)
+		}
+		params.Tint = hex
+	}
+	if (params.Gray && params.Sepia) || ((params.Gray || params.Sepia) && params.Tint != "") {
+		return fmt.Errorf("use only one of gray, sepia or tint")
+	}
+
+	for _, adj := range []struct {
+		name  string
+		value int
+	}{{"bri", params.Brightness}, {"con", params.Contrast}, {"sat", params.Saturation}} {
+		if adj.value != 0 {
+			params.appendCacheKey(adj.name + strconv.Itoa(adj.value))
+		}
+	}
+	switch {
+	case params.Gray:
+		params.appendCacheKey("gray")
+	case params.Sepia:
+		params.appendCacheKey("sepia")
+	case params.Tint != "":
+		params.appendCacheKey("tint-" + params.Tint)
+	}
+	return nil
+}
+
+// applyColorOps applies the color operations in params. Modifies in place.
+func applyColorOps(img *vips.ImageRef, params *ResizeParams) error {
+	if params.Brightness != 0 || params.Contrast != 0 || params.Saturation != 0 {
+		if err := adjustLCh(img, params); err != nil {
+			return err
+		}
+	}
+	switch {
+	case params.Gray:
+		return img.ToColorSpace(vips.InterpretationBW)
+	case params.Sepia:
+		return recombRGB(img, sepiaMatrix)
+	case params.Tint != "":
+		c := bgColor(params.Tint)
+		var m [3][3]float64
+		for i, channel := range []uint8{c.R, c.G, c.B} {
+			for j, w := range lumaWeights {
+				m[i][j] = float64(channel) / 255 * w
+			}
+		}
+		return recombRGB(img, m)
+	}
+	return nil
+}
+
+// adjustLCh applies bri/con/sat in LCh space: brightness scales L, contrast
+// stretches L around 50, saturation scales C. Like vips.Modulate, the image is
+// converted back to its original color space.
+func adjustLCh(img *vips.ImageRef, params *ResizeParams) error {
+	colorspace := img.ColorSpace()
+	if colorspace == vips.InterpretationRGB {
+		colorspace = vips.InterpretationSRGB
+	}
+	bri := 1 + float64(params.Brightness)/100
+	con := 1 + float64(params.Contrast)/100
+	sat := 1 + float64(params.Saturation)/100
+
+	mul := []float64{bri * con, sat, 1}
+	add := []float64{50 * (1 - con), 0, 0}
+	if img.HasAlpha() {
+		mul = append(mul, 1)
+		add = append(add, 0)
+	}
+	if err := img.ToColorSpace(vips.InterpretationLCH); err != nil {
+		return err
+	}
+	if err := img.Linear(mul, add); err != nil {
+		return err
+	}
+	return img.ToColorSpace(colorspace)
+}
+
+// recombRGB multiplies the RGB bands by a 3x3 matrix, leaving alpha as is.
+// Grayscale images are converted to sRGB first; the band format is restored.
+func recombRGB(img *vips.ImageRef, matrix [3][3]float64) error {
+	if img.Bands() < 3 {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+	format := img.BandFormat()
+
+	rows := make([][]float64, 3)
+	for i := range matrix {
+		rows[i] = append([]float64{}, matrix[i][:]...)
+	}
+	if img.HasAlpha() {
+		for i := range rows {
+			rows[i] = append(rows[i], 0)
+		}
+		rows = append(rows, []float64{0, 0, 0, 1})
+	}
+	if err := img.Recomb(rows); err != nil {
+		return err
+	}
+	return img.Cast(format)
+}
+
+// Filter caps: larger sigmas cost a lot of CPU for no visible difference
+const (
+	maxBlurSigma   = 50
+	maxSharpen     = 10
+	sharpenSigma   = 1.0 // unsharp mask radius, tuned for web-sized images
+	sharpenFlatMax = 2.0 // vips x1: flat/jagged threshold
+)
+
+// parseDecimal parses a min..max param rounded to one decimal, 0 when absent.
+func parseDecimal(q url.Values, key string, min, max float64) (float64, error) {
+	s := q.Get(key)
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(v >= min && v <= max) { // NaN fails too
+		return 0, fmt.Errorf("invalid %s, use %s=%g..%g", key, key, min, max)
+	}
+	// One decimal keeps cache variants bounded
+	return math.Round(v*10) / 10, nil
+}
+
+// parseFilters parses blur= and sharpen= into params and their cache key
+// tokens ("blur20", "sharpen1.5").
+func parseFilters(q url.Values, params *ResizeParams) error {
+	var err error
+	if params.Blur, err = parseDecimal(q, "blur", 0.5, maxBlurSigma); err != nil {
+		return err
+	}
+	if params.Sharpen, err = parseDecimal(q, "sharpen", 0.5, maxSharpen); err != nil {
+		return err
+	}
+	if params.Blur > 0 {
+		params.appendCacheKey("blur" + strconv.FormatFloat(params.Blur, 'f', -1, 64))
+	}
+	if params.Sharpen > 0 {
+		params.appendCacheKey("sharpen" + strconv.FormatFloat(params.Sharpen, 'f', -1, 64))
+	}
+	return nil
+}
+
+// applyBlur blurs img per blur=. Runs while alpha is still premultiplied so
+// transparent pixels don't bleed into the edges. Modifies in place.
+func applyBlur(img *vips.ImageRef, params *ResizeParams) error {
+	if params.Blur == 0 {
+		return nil
+	}
+	return img.GaussianBlur(params.Blur)
+}
+
+// applySharpen sharpens img per sharpen=. Modifies in place.
+func applySharpen(img *vips.ImageRef, params *ResizeParams) error {
+	if params.Sharpen == 0 {
+		return nil
+	}
+	return img.Sharpen(sharpenSigma, sharpenFlatMax, params.Sharpen)
+}
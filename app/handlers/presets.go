@@ -0,0 +1,178 @@
+package handlers
+
+// Named resize presets.
+//
+// Presets map a name onto a params string in the regular path grammar, loaded
+// from a JSON file (PRESETS_FILE, default presets.json):
+//
+//   {"card": "c300x200", "hero": "w1200.webp", "thumb": "c80&q=60"}
+//
+// and are requested as /r/p=card?src or /r/p=hero.png?src (a request extension
+// overrides the preset's). Other params in the request override the preset's
+// values. Presets resolve before parsing, so the cache key is built from the
+// resolved params and /r/p=card shares entries with /r/c300x200.
+//
+// PRESETS_ONLY=true rejects raw size/op params - only p= (plus format) is
+// accepted, so clients can't mint arbitrary variants.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// presets maps preset name to its resolved query values
+var presets = map[string]url.Values{}
+
+// presetSources keeps the preset params strings as configured, for /config
+var presetSources = map[string]string{}
+
+// PresetsOnly rejects requests that use raw params instead of a preset
+var PresetsOnly bool
+
+// presetOnlyKeys are the request params still accepted in PRESETS_ONLY mode
+// (format selection, source URL and signature don't create size variants).
+var presetOnlyKeys = map[string]bool{"p": true, "f": true, "to": true, "src": true, "s": true}
+
+var presetNamePattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// PresetInfo describes a configured preset for the admin dashboard
+type PresetInfo struct {
+	Name   string `json:"name"`
+	Params string `json:"params"`
+}
+
+// InitPresets loads presets from PRESETS_FILE (default presets.json) and reads
+// PRESETS_ONLY. Must be called after godotenv.Load() and InitJXL(). A missing
+// default file is not an error.
+func InitPresets() {
+	path := os.Getenv("PRESETS_FILE")
+	explicit := path != ""
+	if !explicit {
+		path = "presets.json"
+	}
+
+	PresetsOnly = os.Getenv("PRESETS_ONLY") == "true" || os.Getenv("PRESETS_ONLY") == "1"
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if explicit || !os.IsNotExist(err) {
+			log.Printf("Failed to read presets file '%s': %v", path, err)
+		}
+		if PresetsOnly {
+			log.Println("Warning: PRESETS_ONLY is set but no presets are loaded")
+		}
+		return
+	}
+
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		log.Printf("Invalid presets file '%s': %v", path, err)
+		return
+	}
+
+	if err := loadPresets(raw); err != nil {
+		log.Printf("Presets: %v", err)
+	}
+	log.Printf("Loaded %d resize presets from %s (presets only: %v)", len(presets), path, PresetsOnly)
+}
+
+// loadPresets validates and installs presets. Invalid entries are skipped and
+// reported in the returned error.
+func loadPresets(raw map[string]string) error {
+	presets = map[string]url.Values{}
+	presetSources = map[string]string{}
+
+	var bad []string
+	for name, paramsStr := range raw {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !presetNamePattern.MatchString(name) {
+			bad = append(bad, fmt.Sprintf("'%s': invalid name", name))
+			continue
+		}
+		values, err := presetValues(paramsStr)
+		if err != nil {
+			bad = append(bad, fmt.Sprintf("'%s': %v", name, err))
+			continue
+		}
+		presets[name] = values
+		presetSources[name] = paramsStr
+	}
+
+	if len(bad) > 0 {
+		sort.Strings(bad)
+		return fmt.Errorf("skipped invalid presets: %s", strings.Join(bad, "; "))
+	}
+	return nil
+}
+
+// presetValues converts a preset params string ("w1200.webp", "c300x200&q=80")
+// into query values and checks that it parses.
+func presetValues(paramsStr string) (url.Values, error) {
+	path, ext := splitFormatExt(strings.TrimSpace(paramsStr))
+	values := pathParamValues(path)
+	if ext != "" {
+		values.Set("f", ext)
+	}
+	if values.Get("p") != "" {
+		return nil, fmt.Errorf("presets can't reference other presets")
+	}
+	if _, err := parseResizeValues(values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// resolvePreset expands p=<name> into the preset's values, with any other
+// request values taking precedence. In PRESETS_ONLY mode, raw params are
+// rejected.
+func resolvePreset(q url.Values) (url.Values, error) {
+	if PresetsOnly {
+		for key := range q {
+			if !presetOnlyKeys[key] {
+				return nil, fmt.Errorf("parameter '%s' not allowed, only presets (p=name) are accepted", key)
+			}
+		}
+	}
+
+	name := strings.ToLower(q.Get("p"))
+	if name == "" {
+		return q, nil
+	}
+	preset, ok := presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset '%s'", name)
+	}
+
+	resolved := url.Values{}
+	for key, vals := range preset {
+		resolved[key] = vals
+	}
+	for key, vals := range q {
+		if key != "p" {
+			resolved[key] = vals
+		}
+	}
+	return resolved, nil
+}
+
+// ListPresets returns the configured presets sorted by name
+func ListPresets() []PresetInfo {
+	list := make([]PresetInfo, 0, len(presetSources))
+	for name, paramsStr := range presetSources {
+		list = append(list, PresetInfo{Name: name, Params: paramsStr})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// LoadPresetsForTest installs presets and the presets-only flag for tests
+func LoadPresetsForTest(raw map[string]string, only bool) error {
+	PresetsOnly = only
+	return loadPresets(raw)
+}
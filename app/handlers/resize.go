@@ -1,11 +1,14 @@
 package handlers
 
 import (
+	"encoding/base64"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -24,6 +27,18 @@ var MaxSize int
 // AllowedDomains is a list of domains allowed as image sources (empty = allow all)
 var AllowedDomains []string
 
+// QualityMin and QualityMax bound per-request q= values (QUALITY_MIN, QUALITY_MAX)
+var (
+	QualityMin = 40
+	QualityMax = 100
+)
+
+// AllowUpscale lets requests opt into enlargement with up=1 (ALLOW_UPSCALE)
+var AllowUpscale bool
+
+// MaxUpscale caps the enlargement factor of up=1 requests (MAX_UPSCALE)
+var MaxUpscale = 2.0
+
 // Shared HTTP client for fetching remote images
 var httpClient *http.Client
 
@@ -86,15 +101,82 @@ func InitAllowedDomains() {
 	}
 }
 
+// InitUpscale reads ALLOW_UPSCALE and MAX_UPSCALE from environment. Must be
+// called after godotenv.Load() and before presets are loaded.
+func InitUpscale() {
+	AllowUpscale = os.Getenv("ALLOW_UPSCALE") == "true" || os.Getenv("ALLOW_UPSCALE") == "1"
+
+	if maxStr := os.Getenv("MAX_UPSCALE"); maxStr != "" {
+		factor, err := strconv.ParseFloat(maxStr, 64)
+		if err != nil || factor < 1 || factor > 8 {
+			log.Printf("Invalid MAX_UPSCALE value '%s', must be 1-8, using default 2", maxStr)
+		} else {
+			MaxUpscale = factor
+		}
+	}
+	if AllowUpscale {
+		log.Printf("Upscaling allowed with up=1, max factor %g", MaxUpscale)
+	}
+}
+
+// InitQualityBounds reads QUALITY_MIN and QUALITY_MAX from environment, the
+// admin bounds q= values are clamped to. Must be called after godotenv.Load()
+// and before presets are loaded.
+func InitQualityBounds() {
+	minQ, maxQ := QualityMin, QualityMax
+	if v := os.Getenv("QUALITY_MIN"); v != "" {
+		q, err := strconv.Atoi(v)
+		if err != nil || q < 40 || q > 100 {
+			log.Printf("Invalid QUALITY_MIN value '%s', must be 40-100, using default %d", v, minQ)
+		} else {
+			minQ = q
+		}
+	}
+	if v := os.Getenv("QUALITY_MAX"); v != "" {
+		q, err := strconv.Atoi(v)
+		if err != nil || q < 40 || q > 100 {
+			log.Printf("Invalid QUALITY_MAX value '%s', must be 40-100, using default %d", v, maxQ)
+		} else {
+			maxQ = q
+		}
+	}
+	if minQ > maxQ {
+		log.Printf("QUALITY_MIN %d is above QUALITY_MAX %d, ignoring both", minQ, maxQ)
+		return
+	}
+	QualityMin, QualityMax = minQ, maxQ
+	log.Printf("Per-request quality (q=) clamped to %d-%d", QualityMin, QualityMax)
+}
+
+// SetQualityBoundsForTest sets the q= clamp bounds for tests
+func SetQualityBoundsForTest(minQ, maxQ int) {
+	QualityMin, QualityMax = minQ, maxQ
+}
+
+// SetUpscaleForTest sets the upscale policy for tests
+func SetUpscaleForTest(allow bool, maxFactor float64) {
+	AllowUpscale = allow
+	MaxUpscale = maxFactor
+}
+
 // forcedFormats are output formats requestable via a path extension
 // (/r.glb, /r/w300.png) or the f= param. "glb" applies to STEP sources only.
 var forcedFormats = map[string]bool{
 	"png": true, "jpg": true, "jpeg": true, "webp": true,
-	"avif": true, "gif": true, "glb": true,
+	"avif": true, "gif": true, "jxl": true, "glb": true,
 }
 
 // ForcedExtensions lists the extensions registered as /r.{ext} routes in main.
-var ForcedExtensions = []string{"png", "jpg", "jpeg", "webp", "avif", "gif", "glb"}
+var ForcedExtensions = []string{"png", "jpg", "jpeg", "webp", "avif", "gif", "jxl", "glb"}
+
+// checkFormatAvailable rejects a forced format this libvips build can't
+// encode, whether it came from f=, a path extension or /srcset.
+func checkFormatAvailable(f string) error {
+	if f == "jxl" && !JXLEnabled {
+		return fmt.Errorf("jxl output is not available, libvips was built without JPEG XL")
+	}
+	return nil
+}
 
 // splitFormatExt strips a trailing .ext from a params path segment when ext is
 // a known forced format. Only known formats strip, so dotted cam vectors like
@@ -112,9 +194,32 @@ func splitFormatExt(path string) (string, string) {
 // SplitFormatExtForTest exposes splitFormatExt for tests
 func SplitFormatExtForTest(p string) (string, string) { return splitFormatExt(p) }
 
+// splitB64Source strips a trailing "b64/<base64url(src)>" segment from a params
+// path (/r/w300/b64/aHR0cHM6Ly9...). Returns the remaining params path and the
+// decoded source URL ("" when the path has no b64 segment). Padding is optional.
+func splitB64Source(path string) (string, string, error) {
+	var rest, encoded string
+	if strings.HasPrefix(path, "b64/") {
+		encoded = path[len("b64/"):]
+	} else if idx := strings.Index(path, "/b64/"); idx != -1 {
+		rest, encoded = path[:idx], path[idx+len("/b64/"):]
+	} else {
+		return path, "", nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil || len(decoded) == 0 {
+		return "", "", fmt.Errorf("invalid base64url source")
+	}
+	return rest, string(decoded), nil
+}
+
+// SplitB64SourceForTest exposes splitB64Source for tests
+func SplitB64SourceForTest(p string) (string, string, error) { return splitB64Source(p) }
+
 // formatName normalizes a vips ImageType to a friendly format string.
-// vips maps AVIF to "heif" internally, but we surface "avif" for clarity
-// and existing cache-format compatibility.
+// vips loads AVIF and HEIC through the same heif loader; sources are told
+// apart by their ftyp brand (heifBrand), this only covers the fallback.
 func formatName(t vips.ImageType) string {
 	switch t {
 	case vips.ImageTypeJPEG:
@@ -125,12 +230,18 @@ func formatName(t vips.ImageType) string {
 		return "gif"
 	case vips.ImageTypeWEBP:
 		return "webp"
-	case vips.ImageTypeAVIF, vips.ImageTypeHEIF:
+	case vips.ImageTypeAVIF:
 		return "avif"
+	case vips.ImageTypeHEIF:
+		return "heic"
+	case vips.ImageTypeJXL:
+		return "jxl"
 	case vips.ImageTypeSVG:
 		return "svg"
 	case vips.ImageTypeTIFF:
 		return "tiff"
+	case vips.ImageTypePDF:
+		return "pdf"
 	case vips.ImageTypeBMP:
 		return "bmp"
 	}
@@ -148,6 +259,16 @@ func encodeAVIF(img *vips.ImageRef, quality int) ([]byte, error) {
 	return data, err
 }
 
+// encodeJXL exports the image as JPEG XL.
+func encodeJXL(img *vips.ImageRef, quality int) ([]byte, error) {
+	params := vips.NewJxlExportParams()
+	params.Quality = quality
+	// Effort 1..9: the default 7 is too slow for on-the-fly encoding
+	params.Effort = 4
+	data, _, err := img.ExportJxl(params)
+	return data, err
+}
+
 // encodeWebP exports the image as WebP.
 func encodeWebP(img *vips.ImageRef, quality int) ([]byte, error) {
 	params := vips.NewWebpExportParams()
@@ -159,7 +280,7 @@ func encodeWebP(img *vips.ImageRef, quality int) ([]byte, error) {
 
 // encodeJPEG exports the image as JPEG. Alpha is flattened onto white first -
 // JPEG has no alpha and vips would otherwise composite onto black.
-func encodeJPEG(img *vips.ImageRef, quality int) ([]byte, error) {
+func encodeJPEG(img *vips.ImageRef, quality int, opts JPEGOptions) ([]byte, error) {
 	if img.HasAlpha() {
 		if err := img.Flatten(&vips.Color{R: 255, G: 255, B: 255}); err != nil {
 			return nil, err
@@ -168,14 +289,20 @@ func encodeJPEG(img *vips.ImageRef, quality int) ([]byte, error) {
 	params := vips.NewJpegExportParams()
 	params.Quality = quality
 	params.StripMetadata = true
+	params.Interlace = opts.Interlace
+	params.OptimizeCoding = opts.Optimize
+	params.TrellisQuant = opts.Trellis
+	params.SubsampleMode = opts.Subsample
 	data, _, err := img.ExportJpeg(params)
 	return data, err
 }
 
 // encodePNG exports the image as PNG.
-func encodePNG(img *vips.ImageRef) ([]byte, error) {
+func encodePNG(img *vips.ImageRef, opts PNGOptions) ([]byte, error) {
 	params := vips.NewPngExportParams()
 	params.StripMetadata = true
+	params.Compression = opts.Compression
+	params.Filter = opts.Filter
 	data, _, err := img.ExportPng(params)
 	return data, err
 }
@@ -188,41 +315,48 @@ func encodeGIF(img *vips.ImageRef) ([]byte, error) {
 }
 
 // encodeFallback encodes image in its original (non-WebP/AVIF) format,
-// matching the prior behavior: JPEG/PNG natively, everything else as JPEG.
+// matching the prior behavior: JPEG/PNG natively, GIF stills (anim=0) as PNG
+// to keep transparency, everything else (AVIF and HEIC sources included) as
+// JPEG.
 // Returns (data, mimeType, formatName, error).
-func encodeFallback(format string, img *vips.ImageRef) ([]byte, string, string, error) {
+func encodeFallback(format string, img *vips.ImageRef, params *ResizeParams) ([]byte, string, string, error) {
+	quality := params.encodeQuality()
 	switch format {
-	case "png":
-		data, err := encodePNG(img)
+	case "png", "gif":
+		data, err := encodePNG(img, params.pngOptions())
 		return data, "image/png", "png", err
 	case "jpeg", "jpg":
-		data, err := encodeJPEG(img, AVIFQuality)
+		data, err := encodeJPEG(img, quality, params.jpegOptions())
 		return data, "image/jpeg", "jpeg", err
 	default:
-		data, err := encodeJPEG(img, AVIFQuality)
+		data, err := encodeJPEG(img, quality, params.jpegOptions())
 		return data, "image/jpeg", "jpeg", err
 	}
 }
 
 // encodeForced encodes img in an explicitly requested format - unlike
 // encodeFallback there is no silent fallback, failure is an error.
-func encodeForced(format string, img *vips.ImageRef) ([]byte, string, string, error) {
+func encodeForced(format string, img *vips.ImageRef, params *ResizeParams) ([]byte, string, string, error) {
+	quality := params.encodeQuality()
 	switch format {
 	case "png":
-		data, err := encodePNG(img)
+		data, err := encodePNG(img, params.pngOptions())
 		return data, "image/png", "png", err
 	case "jpg", "jpeg":
-		data, err := encodeJPEG(img, AVIFQuality)
+		data, err := encodeJPEG(img, quality, params.jpegOptions())
 		return data, "image/jpeg", "jpeg", err
 	case "webp":
-		data, err := encodeWebP(img, AVIFQuality)
+		data, err := encodeWebP(img, quality)
 		return data, "image/webp", "webp", err
 	case "avif":
-		data, err := encodeAVIF(img, AVIFQuality)
+		data, err := encodeAVIF(img, quality)
 		return data, "image/avif", "avif", err
 	case "gif":
 		data, err := encodeGIF(img)
 		return data, "image/gif", "gif", err
+	case "jxl":
+		data, err := encodeJXL(img, quality)
+		return data, "image/jxl", "jxl", err
 	}
 	return nil, "", "", fmt.Errorf("unsupported forced format '%s'", format)
 }
@@ -267,18 +401,22 @@ func isAllowedSource(srcURL string, r *http.Request) bool {
 	}
 
 	for _, allowed := range AllowedDomains {
-		if strings.HasPrefix(allowed, "*.") {
-			suffix := allowed[1:]
-			if host == allowed[2:] || strings.HasSuffix(host, suffix) {
-				return true
-			}
-		} else if host == allowed {
+		if hostMatches(host, allowed) {
 			return true
 		}
 	}
 	return false
 }
 
+// hostMatches reports whether host matches a domain pattern: an exact host,
+// or "*.example.com" for example.com and any subdomain of it.
+func hostMatches(host, pattern string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return host == pattern[2:] || strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
 // isPrivateHost checks if a hostname looks like a private/internal address (SSRF protection)
 func isPrivateHost(srcURL string) bool {
 	parsed, err := url.Parse(srcURL)
@@ -330,38 +468,110 @@ func enforceMaxSize(img *vips.ImageRef) error {
 	return img.Resize(scale, vips.KernelLanczos3)
 }
 
-// Check if client accepts WebP
-func acceptsWebP(r *http.Request) bool {
-	return strings.Contains(r.Header.Get("Accept"), "image/webp")
-}
-
-// Check if client accepts AVIF
-func acceptsAVIF(r *http.Request) bool {
-	return strings.Contains(r.Header.Get("Accept"), "image/avif")
-}
-
 // ResizeParams holds the resize parameters
 type ResizeParams struct {
 	Width         int
 	Height        int
+	AutoWidth     bool // w=auto: Width from client hints when sent
 	CropMode      bool
 	CacheKey      string
-	Format        string // forced output format, "" = negotiate via Accept; "glb" = STEP to GLB
-	CamDir        string // f3d camera direction vector (STEP renders)
-	CamKey        string // cam token for cache keys (STEP renders)
-	BgTransparent bool   // STEP render with transparent background (f3d --no-background), the default
-	BgKey         string // bg token for cache keys (STEP renders): "transparent" or "white"
+	Format        string       // forced output format, "" = negotiate via Accept; "glb" = STEP to GLB
+	CamDir        string       // f3d camera direction vector (STEP renders)
+	CamKey        string       // cam token for cache keys (STEP renders)
+	Fit           string       // explicit fit mode (fit=): "pad", "fill", "outside"; "" = CropMode decides
+	Quality       int          // per-request encode quality (q=), 0 = AVIFQuality
+	Upscale       bool         // up=1 with ALLOW_UPSCALE: enlarge up to MaxUpscale instead of keeping the original size
+	Still         bool         // anim=0: first frame of animated sources only
+	Page          int          // page= of PDF/TIFF sources, 1-based, 0 = first page
+	Density       int          // density= PDF render DPI, 0 = defaultDensity
+	JPEG          *JPEGOptions // interlace=, optimize=, ... JPEG settings, nil = JPEGDefaults
+	PNG           *PNGOptions  // pngcomp=, pngfilter= PNG settings, nil = PNGDefaults
+	Rect          [4]float64   // source region x, y, w, h (rect= pixels or rectp= percent)
+	RectPercent   bool         // Rect is in percent of the image (rectp=)
+	HasRect       bool         // rect= or rectp= given
+	Trim          int          // trim= color distance threshold, 0 = no trim
+	TrimColor     string       // trimcolor= as 6-digit hex, "" = top-left pixel
+	Rotate        int          // clockwise rotation (rot=): 0, 90, 180 or 270
+	Flip          string       // mirror after rotation (flip=): "h", "v" or ""
+	Brightness    int          // bri=, -100..100 percent
+	Contrast      int          // con=, -100..100 percent
+	Saturation    int          // sat=, -100..100 percent
+	Gray          bool         // gray=1
+	Sepia         bool         // sepia=1
+	Tint          string       // tint= as 6-digit hex, "" = none
+	Blur          float64      // blur= Gaussian sigma, 0 = none
+	Sharpen       float64      // sharpen= strength, 0 = none
+	Text          string       // txt= overlay text, "" = none
+	TextSize      int          // txtsize= in output pixels, 0 = a tenth of the output width
+	TextColor     string       // txtcolor= as 6-digit hex
+	TextGravity   string       // txtg= compass gravity
+	Watermark     string       // registered watermark name (wm= or enforced per source domain), "" = none
+	BgTransparent bool         // transparent background for STEP renders and fit=pad, the default
+	BgKey         string       // bg token for cache keys: "transparent", "white" or 6-digit hex
+	DPR           float64      // device pixel ratio multiplier for Width/Height, 0 or 1 = none
+	Gravity       string       // crop anchor (g=): center, north, ..., attention/entropy (smart crop), "" = default 70/30 focus
+	FocalX        float64      // crop focal point (fp=x,y) as 0..1 fractions
+	FocalY        float64
+	HasFocal      bool
+}
+
+// appendCacheKey adds an op token to the cache key ("w_300" -> "w_300_dpr2").
+func (p *ResizeParams) appendCacheKey(token string) {
+	if p.CacheKey == "" {
+		p.CacheKey = token
+	} else {
+		p.CacheKey += "_" + token
+	}
+}
+
+// encodeQuality returns the q= quality, or the server default.
+func (p *ResizeParams) encodeQuality() int {
+	if p.Quality > 0 {
+		return p.Quality
+	}
+	return AVIFQuality
+}
+
+// targetSize returns the effective pixel dimensions: Width/Height scaled by DPR.
+func (p *ResizeParams) targetSize() (int, int) {
+	if p.DPR <= 1 {
+		return p.Width, p.Height
+	}
+	return int(math.Round(float64(p.Width) * p.DPR)), int(math.Round(float64(p.Height) * p.DPR))
 }
 
 // parseResizeParams parses w=100x100 or c=100x100 parameters (also accepts width/height/crop)
 func parseResizeParams(r *http.Request) (*ResizeParams, error) {
+	_, params, err := resolveResizeValues(r.URL.Query())
+	return params, err
+}
+
+// resolveResizeValues expands presets in request values and parses them.
+// Returns the resolved values too, the base client hints derive variants from.
+func resolveResizeValues(q url.Values) (url.Values, *ResizeParams, error) {
+	q, err := resolvePreset(q)
+	if err != nil {
+		return nil, nil, err
+	}
+	params, err := parseResizeValues(q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return q, params, nil
+}
+
+// parseResizeValues parses already preset-resolved query values into ResizeParams
+func parseResizeValues(q url.Values) (*ResizeParams, error) {
 	params := &ResizeParams{}
 
-	// Forced output format: f=png|jpg|webp|avif|gif|glb ("jpeg" normalized to "jpg")
-	if f := strings.ToLower(r.URL.Query().Get("f")); f != "" {
+	// Forced output format: f=png|jpg|webp|avif|gif|jxl|glb ("jpeg" normalized to "jpg")
+	if f := strings.ToLower(q.Get("f")); f != "" {
 		if !forcedFormats[f] {
 			return nil, fmt.Errorf("invalid f parameter '%s'", f)
 		}
+		if err := checkFormatAvailable(f); err != nil {
+			return nil, err
+		}
 		if f == "jpeg" {
 			f = "jpg"
 		}
@@ -369,13 +579,13 @@ func parseResizeParams(r *http.Request) (*ResizeParams, error) {
 	}
 
 	// to=glb kept as a back-compat alias for f=glb / the .glb extension
-	if to := r.URL.Query().Get("to"); to != "" {
+	if to := q.Get("to"); to != "" {
 		if to != "glb" {
 			return nil, fmt.Errorf("invalid to parameter '%s', only 'glb' is supported", to)
 		}
 		params.Format = "glb"
 	}
-	if cam := r.URL.Query().Get("cam"); cam != "" {
+	if cam := q.Get("cam"); cam != "" {
 		dir, key, err := parseCam(cam)
 		if err != nil {
 			return nil, err
@@ -384,16 +594,139 @@ func parseResizeParams(r *http.Request) (*ResizeParams, error) {
 		params.CamKey = key
 	}
 	// Always resolved so the default (transparent) lands in the cache key too
-	transparent, bgKey, err := parseBg(r.URL.Query().Get("bg"))
+	transparent, bgKey, err := parseBg(q.Get("bg"))
 	if err != nil {
 		return nil, err
 	}
 	params.BgTransparent = transparent
 	params.BgKey = bgKey
 
-	cropStr := r.URL.Query().Get("c")
-	if cropStr == "" {
-		cropStr = r.URL.Query().Get("crop")
+	if err := parseSizeParams(q, params); err != nil {
+		return nil, err
+	}
+	if err := parseFit(q.Get("fit"), params); err != nil {
+		return nil, err
+	}
+
+	// up=1 opts into enlargement; ignored (and kept out of the cache key)
+	// unless the server allows upscaling
+	switch q.Get("up") {
+	case "", "0", "false":
+	case "1", "true":
+		if AllowUpscale && (params.Width > 0 || params.Height > 0) {
+			params.Upscale = true
+			params.appendCacheKey("up")
+		}
+	default:
+		return nil, fmt.Errorf("invalid up parameter, use up=1")
+	}
+
+	if dprStr := q.Get("dpr"); dprStr != "" {
+		dpr, err := strconv.ParseFloat(dprStr, 64)
+		// Written so NaN fails too
+		if err != nil || !(dpr >= 1 && dpr <= 4) {
+			return nil, fmt.Errorf("invalid dpr, use dpr=1..4")
+		}
+		// One decimal is plenty (1.5, 2.6) and keeps cache variants bounded
+		params.DPR = math.Round(dpr*10) / 10
+		if params.DPR > 1 && (params.Width > 0 || params.Height > 0) {
+			params.appendCacheKey("dpr" + strconv.FormatFloat(params.DPR, 'f', -1, 64))
+		}
+	}
+
+	g := q.Get("g")
+	if g == "" && strings.EqualFold(q.Get("crop"), "smart") {
+		g = "attention"
+	}
+	if g != "" {
+		gravity, err := parseGravity(g)
+		if err != nil {
+			return nil, err
+		}
+		params.Gravity = gravity
+	}
+	if fp := q.Get("fp"); fp != "" {
+		if params.Gravity != "" {
+			return nil, fmt.Errorf("use either g or fp, not both")
+		}
+		x, y, err := parseFocalPoint(fp)
+		if err != nil {
+			return nil, err
+		}
+		params.FocalX, params.FocalY, params.HasFocal = x, y, true
+	}
+	if params.Fit == "pad" {
+		if _, smart := smartGravities[params.Gravity]; smart || params.HasFocal {
+			return nil, fmt.Errorf("fit=pad only supports compass g= values")
+		}
+	}
+	// Anchors only move the crop window (or the image on a pad canvas), so
+	// they only split the cache in those modes
+	if params.CropMode || params.Fit == "pad" {
+		if params.HasFocal {
+			params.appendCacheKey(focalToken(params.FocalX, params.FocalY))
+		} else if params.Gravity != "" {
+			params.appendCacheKey("g-" + params.Gravity)
+		}
+	}
+
+	// q=40..100, clamped to the admin bounds; the token carries the clamped
+	// value so out-of-bounds requests share the bounded variant
+	if qStr := q.Get("q"); qStr != "" {
+		quality, err := strconv.Atoi(qStr)
+		if err != nil || quality < 40 || quality > 100 {
+			return nil, fmt.Errorf("invalid q, use q=40..100")
+		}
+		if quality < QualityMin {
+			quality = QualityMin
+		}
+		if quality > QualityMax {
+			quality = QualityMax
+		}
+		params.Quality = quality
+		params.appendCacheKey("q" + strconv.Itoa(quality))
+	}
+
+	if err := parseEncodeOptions(q, params); err != nil {
+		return nil, err
+	}
+	if err := parseAnim(q, params); err != nil {
+		return nil, err
+	}
+	if err := parseDocument(q, params); err != nil {
+		return nil, err
+	}
+	if err := parseRect(q, params); err != nil {
+		return nil, err
+	}
+	if err := parseTrim(q, params); err != nil {
+		return nil, err
+	}
+	if err := parseOrientation(q, params); err != nil {
+		return nil, err
+	}
+	if err := parseFilters(q, params); err != nil {
+		return nil, err
+	}
+	if err := parseColorOps(q, params); err != nil {
+		return nil, err
+	}
+	if err := parseText(q, params); err != nil {
+		return nil, err
+	}
+	if err := parseWatermark(q, params); err != nil {
+		return nil, err
+	}
+
+	return params, nil
+}
+
+// parseSizeParams parses the c=/w=/h= size params into Width, Height,
+// CropMode and the base CacheKey ("c_300x200", "w_300", "h_200").
+func parseSizeParams(q url.Values, params *ResizeParams) error {
+	cropStr := q.Get("c")
+	if cropStr == "" && !strings.EqualFold(q.Get("crop"), "smart") {
+		cropStr = q.Get("crop")
 	}
 	if cropStr != "" {
 		params.CropMode = true
@@ -401,17 +734,17 @@ func parseResizeParams(r *http.Request) (*ResizeParams, error) {
 		if strings.Contains(cropStr, "x") {
 			parts := strings.Split(cropStr, "x")
 			if len(parts) != 2 {
-				return nil, fmt.Errorf("invalid crop format, use c=100 or c=100x100")
+				return fmt.Errorf("invalid crop format, use c=100 or c=100x100")
 			}
 
 			width, err := strconv.Atoi(parts[0])
 			if err != nil || width <= 0 {
-				return nil, fmt.Errorf("invalid crop width")
+				return fmt.Errorf("invalid crop width")
 			}
 
 			height, err := strconv.Atoi(parts[1])
 			if err != nil || height <= 0 {
-				return nil, fmt.Errorf("invalid crop height")
+				return fmt.Errorf("invalid crop height")
 			}
 
 			params.Width = width
@@ -419,40 +752,46 @@ func parseResizeParams(r *http.Request) (*ResizeParams, error) {
 		} else {
 			size, err := strconv.Atoi(cropStr)
 			if err != nil || size <= 0 {
-				return nil, fmt.Errorf("invalid crop size")
+				return fmt.Errorf("invalid crop size")
 			}
 			params.Width = size
 			params.Height = size
 		}
 
 		params.CacheKey = fmt.Sprintf("c_%dx%d", params.Width, params.Height)
-		return params, nil
+		return nil
 	}
 
-	widthStr := r.URL.Query().Get("w")
+	widthStr := q.Get("w")
 	if widthStr == "" {
-		widthStr = r.URL.Query().Get("width")
+		widthStr = q.Get("width")
 	}
-	heightStr := r.URL.Query().Get("h")
+	heightStr := q.Get("h")
 	if heightStr == "" {
-		heightStr = r.URL.Query().Get("height")
+		heightStr = q.Get("height")
+	}
+
+	// w=auto: width from client hints, the original size without them
+	if strings.EqualFold(widthStr, "auto") {
+		params.AutoWidth = true
+		widthStr = ""
 	}
 
 	if widthStr != "" {
 		if strings.Contains(widthStr, "x") {
 			parts := strings.Split(widthStr, "x")
 			if len(parts) != 2 {
-				return nil, fmt.Errorf("invalid dimension format, use w=100x100")
+				return fmt.Errorf("invalid dimension format, use w=100x100")
 			}
 
 			width, err := strconv.Atoi(parts[0])
 			if err != nil || width <= 0 {
-				return nil, fmt.Errorf("invalid width")
+				return fmt.Errorf("invalid width")
 			}
 
 			height, err := strconv.Atoi(parts[1])
 			if err != nil || height <= 0 {
-				return nil, fmt.Errorf("invalid height")
+				return fmt.Errorf("invalid height")
 			}
 
 			params.Width = width
@@ -461,7 +800,7 @@ func parseResizeParams(r *http.Request) (*ResizeParams, error) {
 		} else {
 			width, err := strconv.Atoi(widthStr)
 			if err != nil || width <= 0 {
-				return nil, fmt.Errorf("invalid width parameter")
+				return fmt.Errorf("invalid width parameter")
 			}
 			params.Width = width
 			params.Height = 0
@@ -472,7 +811,7 @@ func parseResizeParams(r *http.Request) (*ResizeParams, error) {
 	if heightStr != "" {
 		height, err := strconv.Atoi(heightStr)
 		if err != nil || height <= 0 {
-			return nil, fmt.Errorf("invalid height parameter")
+			return fmt.Errorf("invalid height parameter")
 		}
 
 		if params.Width > 0 {
@@ -485,47 +824,91 @@ func parseResizeParams(r *http.Request) (*ResizeParams, error) {
 		}
 	}
 
-	return params, nil
+	return nil
+}
+
+// Upscale states reported in X-Info when the target is larger than the source
+const (
+	upscaleEnlarged  = "enlarged"  // enlarged to the requested size
+	upscaleClamped   = "clamped"   // enlarged, but limited by MAX_UPSCALE or MAX_SIZE
+	upscaleUnchanged = "unchanged" // kept at the original size (no up=1, or not allowed)
+)
+
+// capUpscale limits an enlarging scale to MaxUpscale and reports the resulting
+// upscale state ("" when the scale doesn't enlarge).
+func capUpscale(scale float64, sizeClamped bool) (float64, string) {
+	switch {
+	case scale <= 1:
+		return scale, ""
+	case scale > MaxUpscale:
+		return MaxUpscale, upscaleClamped
+	case sizeClamped:
+		return scale, upscaleClamped
+	}
+	return scale, upscaleEnlarged
+}
+
+// capToMaxSize limits an enlarging scale so a w x h image stays within MaxSize
+// on both sides, updating the upscale state when it has to.
+func capToMaxSize(scale float64, w, h int, state string) (float64, string) {
+	limit := float64(MaxSize) / float64(max(w, h))
+	if scale <= limit {
+		return scale, state
+	}
+	if limit <= 1 {
+		return limit, upscaleUnchanged
+	}
+	return limit, upscaleClamped
 }
 
 // resizeImage applies the resize parameters to the image. Modifies in place.
-func resizeImage(img *vips.ImageRef, params *ResizeParams) error {
-	targetWidth := params.Width
-	targetHeight := params.Height
+// Returns the upscale state when the target exceeds the source, "" otherwise.
+func resizeImage(img *vips.ImageRef, params *ResizeParams) (string, error) {
+	targetWidth, targetHeight := params.targetSize()
 
+	sizeClamped := false
 	if targetWidth > MaxSize {
+		log.Printf("Requested width %d exceeds max size %d, clamped to %d", targetWidth, MaxSize, MaxSize)
 		targetWidth = MaxSize
-		log.Printf("Requested width %d exceeds max size %d, clamped to %d", params.Width, MaxSize, targetWidth)
+		sizeClamped = true
 	}
 	if targetHeight > MaxSize {
+		log.Printf("Requested height %d exceeds max size %d, clamped to %d", targetHeight, MaxSize, MaxSize)
 		targetHeight = MaxSize
-		log.Printf("Requested height %d exceeds max size %d, clamped to %d", params.Height, MaxSize, targetHeight)
+		sizeClamped = true
 	}
 
 	if targetWidth == 0 && targetHeight == 0 {
-		return nil
+		return "", nil
+	}
+	if params.Fit != "" {
+		return fitImage(img, targetWidth, targetHeight, sizeClamped, params)
 	}
 
 	origW := img.Width()
 	origH := img.Height()
 
-	// Skip upscaling - don't enlarge images beyond their original size
-	if !params.CropMode {
-		if targetWidth > 0 && targetHeight > 0 {
+	// Skip upscaling - don't enlarge images beyond their original size unless
+	// the request opted in with up=1
+	if !params.Upscale {
+		if !params.CropMode {
+			if targetWidth > 0 && targetHeight > 0 {
+				if targetWidth >= origW && targetHeight >= origH {
+					return upscaleUnchanged, nil
+				}
+			} else if targetWidth > 0 && targetWidth >= origW {
+				return upscaleUnchanged, nil
+			} else if targetHeight > 0 && targetHeight >= origH {
+				return upscaleUnchanged, nil
+			}
+		} else {
 			if targetWidth >= origW && targetHeight >= origH {
-				return nil
+				return upscaleUnchanged, nil
 			}
-		} else if targetWidth > 0 && targetWidth >= origW {
-			return nil
-		} else if targetHeight > 0 && targetHeight >= origH {
-			return nil
-		}
-	} else {
-		if targetWidth >= origW && targetHeight >= origH {
-			return nil
 		}
 	}
 
+	state := ""
 	if params.CropMode {
 		origWidth := float64(origW)
 		origHeight := float64(origH)
@@ -539,6 +922,16 @@ func resizeImage(img *vips.ImageRef, params *ResizeParams) error {
 		if scaleY > scaleX {
 			scale = scaleY
 		}
+		coverScale := scale
+		if params.Upscale {
+			scale, state = capUpscale(scale, sizeClamped)
+		}
+		// A capped enlargement can't cover the target: shrink the crop window
+		// with it so the output keeps the requested aspect ratio
+		if scale < coverScale {
+			targetWidth = max(int(math.Round(cropTargetWidth*scale/coverScale)), 1)
+			targetHeight = max(int(math.Round(cropTargetHeight*scale/coverScale)), 1)
+		}
 
 		newWidth := int(origWidth * scale)
 		newHeight := int(origHeight * scale)
@@ -546,57 +939,114 @@ func resizeImage(img *vips.ImageRef, params *ResizeParams) error {
 			origW, origH, targetWidth, targetHeight, scale, newWidth, newHeight)
 
 		if err := img.Resize(scale, vips.KernelLanczos3); err != nil {
-			return err
+			return "", err
 		}
 
 		// Re-read in case rounding shifted dimensions
 		curW := img.Width()
 		curH := img.Height()
 
-		// 70% top focus: 30% from top, 70% from bottom
-		cropX := (curW - targetWidth) / 2
-		cropY := int(float64(curH-targetHeight) * 0.3)
-		if cropX < 0 {
-			cropX = 0
-		}
-		if cropY < 0 {
-			cropY = 0
-		}
 		// Clamp width/height so ExtractArea never escapes the bounds
-		w := targetWidth
-		h := targetHeight
-		if cropX+w > curW {
-			w = curW - cropX
-		}
-		if cropY+h > curH {
-			h = curH - cropY
+		w := minInt(targetWidth, curW)
+		h := minInt(targetHeight, curH)
+		if smart, err := smartCrop(img, w, h, params); smart {
+			log.Printf("Smart crop (%s) to %dx%d", params.Gravity, w, h)
+			return state, err
 		}
+		// Focal point, gravity, or the default 70% top focus (30% from top)
+		cropX, cropY := cropOffset(curW, curH, w, h, params)
 		log.Printf("Crop position: x=%d, y=%d, crop to %dx%d", cropX, cropY, w, h)
-		return img.ExtractArea(cropX, cropY, w, h)
+		return state, img.ExtractArea(cropX, cropY, w, h)
 	}
 
+	var scale float64
+	switch {
 	// Both dimensions: fit within constraints (preserve aspect ratio)
-	if targetWidth > 0 && targetHeight > 0 {
+	case targetWidth > 0 && targetHeight > 0:
 		scaleX := float64(targetWidth) / float64(origW)
 		scaleY := float64(targetHeight) / float64(origH)
-		scale := scaleX
+		scale = scaleX
 		if scaleY < scaleX {
 			scale = scaleY
 		}
-		return img.Resize(scale, vips.KernelLanczos3)
+	case targetWidth > 0:
+		scale = float64(targetWidth) / float64(origW)
+	default:
+		scale = float64(targetHeight) / float64(origH)
+	}
+	if params.Upscale {
+		scale, state = capUpscale(scale, sizeClamped)
+		scale, state = capToMaxSize(scale, origW, origH, state)
+	}
+	return state, img.Resize(scale, vips.KernelLanczos3)
+}
+
+// parsePathParams parses a path-form params segment ("w300", "c300x200",
+// "w_300&cam=top") with the same grammar as the query form.
+func parsePathParams(path string) (*ResizeParams, error) {
+	fakeReq := &http.Request{URL: &url.URL{RawQuery: pathParamValues(path).Encode()}}
+	return parseResizeParams(fakeReq)
+}
+
+// pathShorthands are the params accepted in prefix form ("w300", "dpr2").
+// Longer prefixes come first so they win over single letters.
+var pathShorthands = []string{"dpr", "w", "h", "c", "q"}
+
+// pathParamValues converts a path-form params segment into query values:
+// "k=v" pairs pass through, shorthand "w300"/"h_200"/"c300x200"/"dpr2" expand
+// to w=/h=/c=/dpr=.
+func pathParamValues(path string) url.Values {
+	values := url.Values{}
+
+	paramParts := strings.Split(path, "?")
+	for _, param := range strings.Split(paramParts[0], "&") {
+		if param == "" {
+			continue
+		}
+
+		if strings.Contains(param, "=") {
+			parts := strings.SplitN(param, "=", 2)
+			if len(parts) == 2 {
+				values.Set(parts[0], parts[1])
+			}
+		} else {
+			for _, key := range pathShorthands {
+				if strings.HasPrefix(param, key) && len(param) > len(key) {
+					values.Set(key, strings.TrimPrefix(param[len(key):], "_"))
+					break
+				}
+			}
+		}
 	}
+	return values
+}
 
-	if targetWidth > 0 {
-		scale := float64(targetWidth) / float64(origW)
-		return img.Resize(scale, vips.KernelLanczos3)
+// normalizeSrcURL unescapes a source URL and adds a missing or collapsed
+// http(s) scheme ("example.com/a.jpg", "https:/example.com/a.jpg").
+func normalizeSrcURL(srcURL string) (string, error) {
+	decodedURL, err := url.QueryUnescape(srcURL)
+	if err != nil {
+		return "", err
 	}
+	return normalizeScheme(decodedURL), nil
+}
 
-	if targetHeight > 0 {
-		scale := float64(targetHeight) / float64(origH)
-		return img.Resize(scale, vips.KernelLanczos3)
+// normalizeScheme adds a missing or collapsed http(s) scheme without
+// unescaping; base64 sources are used as decoded so "+" and "%2F" survive.
+func normalizeScheme(srcURL string) string {
+	if !strings.HasPrefix(srcURL, "http://") && !strings.HasPrefix(srcURL, "https://") && !strings.HasPrefix(srcURL, "//") {
+		if strings.Contains(srcURL, ".") {
+			srcURL = "https://" + srcURL
+		}
 	}
 
-	return nil
+	if strings.HasPrefix(srcURL, "https:/") && !strings.HasPrefix(srcURL, "https://") {
+		srcURL = strings.Replace(srcURL, "https:/", "https://", 1)
+	}
+	if strings.HasPrefix(srcURL, "http:/") && !strings.HasPrefix(srcURL, "http://") {
+		srcURL = strings.Replace(srcURL, "http:/", "http://", 1)
+	}
+	return srcURL
 }
 
 func ResizeHandler(w http.ResponseWriter, r *http.Request) {
@@ -608,8 +1058,10 @@ func ResizeHandler(w http.ResponseWriter, r *http.Request) {
 		r.Form = values
 	}
 
-	// URL forms: /r/w300?src, /r/w300.png?src (forced format), /r.glb?src (format only)
-	var path, forcedExt string
+	// URL forms: /r/w300?src, /r/w300.png?src (forced format), /r.glb?src (format only),
+	// /r/w300/b64/<base64url(src)>.webp (path only, no query string), each
+	// optionally signed with a leading /r/s:<sig>/ segment
+	var path, forcedExt, signature, b64Src string
 	pathForm := false
 	if strings.HasPrefix(r.URL.Path, "/r.") {
 		forcedExt = strings.ToLower(strings.TrimPrefix(r.URL.Path, "/r."))
@@ -617,54 +1069,32 @@ func ResizeHandler(w http.ResponseWriter, r *http.Request) {
 	} else if p := strings.TrimPrefix(r.URL.Path, "/r/"); p != "" && p != "r" {
 		pathForm = true
 		path, forcedExt = splitFormatExt(p)
+		var err error
+		path, b64Src, err = splitB64Source(path)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid src URL: %v", err), http.StatusBadRequest)
+			return
+		}
+		path, signature = splitSignature(path)
+	} else {
+		signature = r.URL.Query().Get("s")
 	}
 
 	var params *ResizeParams
+	var values url.Values // resolved params, the base for client hints
 	if path != "" {
-		paramParts := strings.Split(path, "?")
-		if len(paramParts) > 0 {
-			fakeReq := &http.Request{URL: &url.URL{}}
-			fakeQuery := url.Values{}
-
-			for _, param := range strings.Split(paramParts[0], "&") {
-				if param == "" {
-					continue
-				}
-
-				if strings.Contains(param, "=") {
-					parts := strings.SplitN(param, "=", 2)
-					if len(parts) == 2 {
-						fakeQuery.Set(parts[0], parts[1])
-					}
-				} else {
-					if len(param) > 1 {
-						paramType := param[0:1]
-						paramValue := param[1:]
-
-						if strings.HasPrefix(paramValue, "_") {
-							paramValue = paramValue[1:]
-						}
-
-						if paramType == "w" || paramType == "h" || paramType == "c" {
-							fakeQuery.Set(paramType, paramValue)
-						}
-					}
-				}
-			}
-			fakeReq.URL.RawQuery = fakeQuery.Encode()
-
-			var err error
-			params, err = parseResizeParams(fakeReq)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Invalid parameters: %v", err), http.StatusBadRequest)
-				return
-			}
+		var err error
+		values, params, err = resolveResizeValues(pathParamValues(path))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid parameters: %v", err), http.StatusBadRequest)
+			return
 		}
 	} else if pathForm {
 		params = &ResizeParams{} // /r.{ext} with no params segment
+		values = url.Values{}
 	} else {
 		var err error
-		params, err = parseResizeParams(r)
+		values, params, err = resolveResizeValues(r.URL.Query())
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Invalid parameters: %v", err), http.StatusBadRequest)
 			return
@@ -672,15 +1102,22 @@ func ResizeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if forcedExt != "" {
+		if err := checkFormatAvailable(forcedExt); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid parameters: %v", err), http.StatusBadRequest)
+			return
+		}
 		if forcedExt == "jpeg" {
 			forcedExt = "jpg"
 		}
 		params.Format = forcedExt
 	}
 
-	// The source URL is now the entire query string for new format
+	// The source URL is now the entire query string for new format; the b64
+	// form ignores the query (CDNs may append or reorder it)
 	var srcURL string
-	if pathForm && r.URL.RawQuery != "" {
+	if b64Src != "" {
+		srcURL = b64Src
+	} else if pathForm && r.URL.RawQuery != "" {
 		srcURL = r.URL.RawQuery
 	} else {
 		srcURL = r.URL.Query().Get("src")
@@ -691,24 +1128,30 @@ func ResizeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	decodedURL, err := url.QueryUnescape(srcURL)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Invalid src URL: %v", err), http.StatusBadRequest)
-		return
+	if b64Src != "" {
+		srcURL = normalizeScheme(srcURL)
+	} else {
+		decodedURL, err := normalizeSrcURL(srcURL)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid src URL: %v", err), http.StatusBadRequest)
+			return
+		}
+		srcURL = decodedURL
 	}
-	srcURL = decodedURL
 
-	if !strings.HasPrefix(srcURL, "http://") && !strings.HasPrefix(srcURL, "https://") && !strings.HasPrefix(srcURL, "//") {
-		if strings.Contains(srcURL, ".") {
-			srcURL = "https://" + srcURL
+	if isStepSource(srcURL) {
+		if err := checkStepBg(params); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid parameters: %v", err), http.StatusBadRequest)
+			return
 		}
 	}
 
-	if strings.HasPrefix(srcURL, "https:/") && !strings.HasPrefix(srcURL, "https://") {
-		srcURL = strings.Replace(srcURL, "https:/", "https://", 1)
-	}
-	if strings.HasPrefix(srcURL, "http:/") && !strings.HasPrefix(srcURL, "http://") {
-		srcURL = strings.Replace(srcURL, "http:/", "http://", 1)
+	if err := verifySignature(signature, params, srcURL); err != nil {
+		if SigningMode == SigningEnforce {
+			http.Error(w, fmt.Sprintf("Invalid signature: %v", err), http.StatusForbidden)
+			return
+		}
+		log.Printf("Signature check failed for %s (params: %s): %v", srcURL, params.CacheKey, err)
 	}
 
 	if len(AllowedDomains) > 0 && isPrivateHost(srcURL) {
@@ -748,25 +1191,41 @@ func ResizeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	useAVIF := acceptsAVIF(r)
-	useWebP := acceptsWebP(r)
+	// Client hints fill in what the URL leaves out. Applied after the
+	// signature check: signatures cover the URL as minted, not the variant.
+	params, vary := applyClientHints(r, values, params)
+	if ClientHints {
+		w.Header().Set("Accept-CH", acceptCH)
+	}
+
+	// After hints, which re-parse params from the request values
+	if err := enforceWatermark(srcURL, params); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid parameters: %v", err), http.StatusForbidden)
+		return
+	}
+
+	// Best accepted format first; the worker falls back down the list
+	formats := negotiateFormats(r.Header.Get("Accept"))
+	useJXL := len(formats) > 0 && formats[0] == "jxl"
+	// AVIF also as the first fallback of a JXL client that ranks it next
+	useAVIF := len(formats) > 0 && formats[0] == "avif" ||
+		(useJXL && len(formats) > 1 && formats[1] == "avif")
+	useWebP := slices.Contains(formats, "webp")
 	formatSuffix := "jpg"
 	if params.Format != "" {
 		// Forced format: deterministic output, skip Accept negotiation
 		formatSuffix = params.Format
-		useAVIF, useWebP = false, false
+		useJXL, useAVIF, useWebP = false, false, false
 	} else {
-		w.Header().Set("Vary", "Accept")
-		if useAVIF {
-			formatSuffix = "avif"
-		} else if useWebP {
-			formatSuffix = "webp"
+		vary = append([]string{"Accept"}, vary...)
+		if len(formats) > 0 {
+			formatSuffix = formats[0]
 		}
 	}
-	cacheKey := params.CacheKey + "_" + formatSuffix
-	if isStepSource(srcURL) {
-		cacheKey = "cam-" + stepCamBgToken(params.CamKey, params.BgKey) + "_" + cacheKey
+	if len(vary) > 0 {
+		w.Header().Set("Vary", strings.Join(vary, ", "))
 	}
+	cacheKey := variantCacheKey(srcURL, params, formatSuffix)
 
 	cachedData, contentType, responseFormat, err := database.GetCachedImage(srcURL, cacheKey)
 	if err != nil {
@@ -787,6 +1246,7 @@ func ResizeHandler(w http.ResponseWriter, r *http.Request) {
 		SrcURL:   srcURL,
 		Params:   params,
 		CacheKey: cacheKey,
+		UseJXL:   useJXL,
 		UseAVIF:  useAVIF,
 		UseWebP:  useWebP,
 	}
@@ -825,6 +1285,16 @@ func ResizeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// variantCacheKey builds the cache key of a resized variant: params key plus
+// output format suffix, with the cam/bg render token for STEP sources.
+func variantCacheKey(srcURL string, params *ResizeParams, formatSuffix string) string {
+	cacheKey := params.CacheKey + "_" + formatSuffix
+	if isStepSource(srcURL) {
+		cacheKey = "cam-" + stepCamBgToken(params.CamKey, params.BgKey) + "_" + cacheKey
+	}
+	return cacheKey
+}
+
 // serveGLB handles /r.glb?url (alias /r/to=glb) - STEP to GLB conversion, cached under key
 // "glb". CORS is open because three.js loads models via fetch, not <img>.
 func serveGLB(w http.ResponseWriter, srcURL string, params *ResizeParams) {
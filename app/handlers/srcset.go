@@ -0,0 +1,326 @@
+package handlers
+
+// srcset / <picture> markup generator.
+//
+//   GET /srcset?url=example.com/a.jpg&widths=320,640,1024&sizes=(max-width: 600px) 100vw, 50vw&f=auto
+//
+// Returns JSON with the srcset string, ready-to-paste <img> and <picture>
+// markup and the individual variant URLs. Any other query params are resize
+// params in the /r/ grammar (q=70, fit=..., p=card) applied to every width;
+// the width itself comes from widths=. f=auto emits AVIF and WebP (and JXL,
+// when enabled) <source> entries with a negotiated <img> fallback, f=<format> forces one format and
+// no f leaves the format to Accept negotiation.
+//
+// URLs are signed when SIGNING_KEY is set. warm=1 queues every variant that
+// isn't cached yet on the worker pool without waiting for it.
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"image-resize/app/database"
+)
+
+// srcsetDefaultWidths are used when widths= is omitted (capped at MaxSize)
+var srcsetDefaultWidths = []int{320, 640, 960, 1280, 1920}
+
+// srcsetMaxWidths bounds the variants a single request can mint
+const srcsetMaxWidths = 16
+
+// srcsetOwnKeys are /srcset params that aren't resize params
+var srcsetOwnKeys = map[string]bool{
+	"url": true, "src": true, "widths": true, "sizes": true,
+	"f": true, "warm": true, "alt": true, "s": true,
+}
+
+// srcsetSizeKeys are rejected: widths= sets the size of each variant
+var srcsetSizeKeys = []string{"w", "width", "h", "height", "c"}
+
+// SrcsetVariant is one generated resize URL
+type SrcsetVariant struct {
+	Width  int    `json:"width"`
+	Format string `json:"format"` // forced format, "" = negotiated
+	URL    string `json:"url"`
+}
+
+// SrcsetSource is a <picture> <source> entry
+type SrcsetSource struct {
+	Type   string `json:"type"`
+	Srcset string `json:"srcset"`
+}
+
+// SrcsetResponse is the JSON returned by /srcset
+type SrcsetResponse struct {
+	Src      string          `json:"src"`
+	Widths   []int           `json:"widths"`
+	Sizes    string          `json:"sizes"`
+	Srcset   string          `json:"srcset"`
+	Sources  []SrcsetSource  `json:"sources,omitempty"`
+	Variants []SrcsetVariant `json:"variants"`
+	Img      string          `json:"img"`
+	Picture  string          `json:"picture"`
+	Signed   bool            `json:"signed"`
+	Warmed   int             `json:"warmed"`
+}
+
+// parseSrcsetWidths parses widths=320,640 into sorted, deduplicated widths.
+func parseSrcsetWidths(s string) ([]int, error) {
+	if s == "" {
+		var widths []int
+		for _, w := range srcsetDefaultWidths {
+			if w <= MaxSize {
+				widths = append(widths, w)
+			}
+		}
+		return widths, nil
+	}
+
+	seen := map[int]bool{}
+	var widths []int
+	for _, part := range strings.Split(s, ",") {
+		w, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid width '%s'", part)
+		}
+		if w > MaxSize {
+			return nil, fmt.Errorf("width %d exceeds max size %d", w, MaxSize)
+		}
+		if !seen[w] {
+			seen[w] = true
+			widths = append(widths, w)
+		}
+	}
+	if len(widths) > srcsetMaxWidths {
+		return nil, fmt.Errorf("too many widths, max %d", srcsetMaxWidths)
+	}
+	sort.Ints(widths)
+	return widths, nil
+}
+
+// srcsetBaseParams turns the request's resize params into a path-form params
+// string ("q=70&fit=pad"), sorted so equal requests produce equal URLs. Values
+// stay unescaped, as ResizeHandler sees them; resizeURL escapes the result.
+func srcsetBaseParams(q url.Values) (string, error) {
+	for _, key := range srcsetSizeKeys {
+		if q.Get(key) != "" {
+			return "", fmt.Errorf("parameter '%s' not allowed, sizes come from widths=", key)
+		}
+	}
+	if crop := q.Get("crop"); crop != "" && !strings.EqualFold(crop, "smart") {
+		return "", fmt.Errorf("parameter 'crop' not allowed, sizes come from widths=")
+	}
+
+	var parts []string
+	for key, vals := range q {
+		if srcsetOwnKeys[key] || len(vals) == 0 {
+			continue
+		}
+		// "&" and "?" end a path-form value however they're escaped
+		if strings.ContainsAny(vals[0], "&?") {
+			return "", fmt.Errorf("parameter '%s' can't contain '&' or '?'", key)
+		}
+		parts = append(parts, key+"="+vals[0])
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&"), nil
+}
+
+// resizeURL builds a /r/ URL path for a params path and source, signed when
+// SIGNING_KEY is set.
+func resizeURL(paramsPath, srcURL string) (string, error) {
+	if len(signingKey) > 0 {
+		return SignURL(paramsPath, srcURL)
+	}
+	return "/r/" + escapeParamsPath(paramsPath) + "?" + escapeSrcURL(srcURL), nil
+}
+
+// requestOrigin returns scheme://host of the request, honoring a TLS-terminating
+// proxy's X-Forwarded-Proto.
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// warmVariant queues a variant on the worker pool unless it's already cached.
+// Returns true when a job was submitted.
+func warmVariant(srcURL string, params *ResizeParams, formatSuffix string) bool {
+	cacheKey := variantCacheKey(srcURL, params, formatSuffix)
+	if cached, _, _, err := database.GetCachedImage(srcURL, cacheKey); err == nil && cached != nil {
+		return false
+	}
+	pool.Submit(&ResizeJob{
+		SrcURL:   srcURL,
+		Params:   params,
+		CacheKey: cacheKey,
+		UseJXL:   formatSuffix == "jxl" && params.Format == "",
+		UseAVIF:  formatSuffix == "avif" && params.Format == "",
+		UseWebP:  (formatSuffix == "avif" || formatSuffix == "webp") && params.Format == "",
+	})
+	return true
+}
+
+// SrcsetHandler generates srcset / <picture> markup for a source image
+func SrcsetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	rawSrc := q.Get("url")
+	if rawSrc == "" {
+		rawSrc = q.Get("src")
+	}
+	if rawSrc == "" {
+		http.Error(w, "Missing url parameter", http.StatusBadRequest)
+		return
+	}
+	// Already unescaped by Query(), a second unescape would alter the source
+	srcURL := normalizeScheme(rawSrc)
+	if len(AllowedDomains) > 0 && isPrivateHost(srcURL) {
+		http.Error(w, "Source URL not allowed", http.StatusForbidden)
+		return
+	}
+	if !isAllowedSource(srcURL, r) {
+		http.Error(w, "Source domain is not allowed", http.StatusForbidden)
+		return
+	}
+
+	widths, err := parseSrcsetWidths(q.Get("widths"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid widths: %v", err), http.StatusBadRequest)
+		return
+	}
+	base, err := srcsetBaseParams(q)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid parameters: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// "" = negotiated; f=auto adds AVIF/WebP <source> variants on top
+	f := strings.ToLower(q.Get("f"))
+	if f == "jpeg" {
+		f = "jpg"
+	}
+	var formats []string
+	switch {
+	case f == "":
+		formats = []string{""}
+	case f == "auto":
+		// One <source> per negotiable format (JXL too when enabled), best first
+		for _, af := range negotiableFormats {
+			formats = append(formats, af.name)
+		}
+		formats = append(formats, "")
+	case forcedFormats[f] && f != "glb":
+		if err := checkFormatAvailable(f); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid f parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+		formats = []string{f}
+	default:
+		http.Error(w, fmt.Sprintf("Invalid f parameter '%s', use auto or an image format", f), http.StatusBadRequest)
+		return
+	}
+
+	sizes := q.Get("sizes")
+	if sizes == "" {
+		sizes = "100vw"
+	}
+	warm := q.Get("warm") == "1" || q.Get("warm") == "true"
+	origin := requestOrigin(r)
+
+	resp := SrcsetResponse{
+		Src:    srcURL,
+		Widths: widths,
+		Sizes:  sizes,
+		Signed: len(signingKey) > 0,
+	}
+	srcsets := map[string][]string{}
+	var fallbackURL string
+	for _, format := range formats {
+		for _, width := range widths {
+			paramsPath := "w" + strconv.Itoa(width)
+			if base != "" {
+				paramsPath += "&" + base
+			}
+			// Same grammar and validation as ResizeHandler (presets, PRESETS_ONLY)
+			_, params, err := resolveResizeValues(pathParamValues(paramsPath))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid parameters: %v", err), http.StatusBadRequest)
+				return
+			}
+			if params.Width != width || params.Height != 0 {
+				http.Error(w, "Invalid parameters: preset sets its own size, sizes come from widths=", http.StatusBadRequest)
+				return
+			}
+			if err := enforceWatermark(srcURL, params); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid parameters: %v", err), http.StatusForbidden)
+				return
+			}
+			if format != "" {
+				paramsPath += "." + format
+				params.Format = format
+			}
+
+			path, err := resizeURL(paramsPath, srcURL)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to build URL: %v", err), http.StatusInternalServerError)
+				return
+			}
+			variantURL := origin + path
+			resp.Variants = append(resp.Variants, SrcsetVariant{Width: width, Format: format, URL: variantURL})
+			srcsets[format] = append(srcsets[format], variantURL+" "+strconv.Itoa(width)+"w")
+			if format == formats[len(formats)-1] {
+				fallbackURL = variantURL
+			}
+
+			if warm {
+				suffix := format
+				if suffix == "" {
+					suffix = "avif" // what current browsers negotiate
+				}
+				if warmVariant(srcURL, params, suffix) {
+					resp.Warmed++
+				}
+			}
+		}
+	}
+	if resp.Warmed > 0 {
+		log.Printf("Srcset: queued %d variants for %s", resp.Warmed, srcURL)
+	}
+
+	resp.Srcset = strings.Join(srcsets[formats[len(formats)-1]], ", ")
+	img := fmt.Sprintf(`<img src="%s" srcset="%s" sizes="%s" alt="%s">`,
+		html.EscapeString(fallbackURL), html.EscapeString(resp.Srcset),
+		html.EscapeString(sizes), html.EscapeString(q.Get("alt")))
+	resp.Img = img
+
+	var picture strings.Builder
+	picture.WriteString("<picture>\n")
+	for _, af := range negotiableFormats {
+		entries, ok := srcsets[af.name]
+		if !ok {
+			continue
+		}
+		source := SrcsetSource{Type: af.mime, Srcset: strings.Join(entries, ", ")}
+		resp.Sources = append(resp.Sources, source)
+		fmt.Fprintf(&picture, "  <source type=\"%s\" srcset=\"%s\" sizes=\"%s\">\n",
+			source.Type, html.EscapeString(source.Srcset), html.EscapeString(sizes))
+	}
+	picture.WriteString("  " + img + "\n</picture>")
+	resp.Picture = picture.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -136,9 +136,13 @@ func parseCam(s string) (dir string, key string, err error) {
 	return s, s, nil
 }
 
-// parseBg validates a bg parameter for STEP renders. Empty, "transparent" and
-// "none" all request an alpha background via f3d --no-background (the default);
-// "white" opts into an opaque white background.
+// parseBg validates a bg parameter. Empty, "transparent" and "none" all request
+// an alpha background (the default; f3d --no-background for STEP renders);
+// "white" or a 3/6-digit hex color ("f0f0f0", "#fff") select an opaque one.
+// Hex keys are normalized to 6 lowercase digits, with ffffff folded into "white"
+// so existing bg=white STEP URLs keep their cache keys and signatures. Hex
+// colors are for fit=pad; STEP renders take transparent or white only
+// (checkStepBg).
 func parseBg(s string) (transparent bool, key string, err error) {
 	s = strings.ToLower(strings.TrimSpace(s))
 	switch s {
@@ -146,9 +150,37 @@ func parseBg(s string) (transparent bool, key string, err error) {
 		return true, "transparent", nil
 	case "white":
 		return false, "white", nil
-	default:
-		return false, "", fmt.Errorf("invalid bg '%s', use transparent (default), none, or white", s)
 	}
+	hex, ok := parseHexColor(s)
+	if !ok {
+		return false, "", fmt.Errorf("invalid bg '%s', use transparent (default), none, white or a hex color", s)
+	}
+	if hex == "ffffff" {
+		return false, "white", nil
+	}
+	return false, hex, nil
+}
+
+// parseHexColor normalizes a 3/6-digit hex color ("#F0F", "f0f0f0") to 6
+// lowercase digits.
+func parseHexColor(s string) (string, bool) {
+	hex := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 || strings.Trim(hex, "0123456789abcdef") != "" {
+		return "", false
+	}
+	return hex, true
+}
+
+// checkStepBg rejects a bg= STEP renders don't support: f3d renders on a
+// transparent or white background, hex colors only apply to fit=pad.
+func checkStepBg(params *ResizeParams) error {
+	if params.BgTransparent || params.BgKey == "white" {
+		return nil
+	}
+	return fmt.Errorf("bg '%s' is not supported for STEP renders, use transparent or white", params.BgKey)
 }
 
 // stepCamBgToken builds the cam/bg token shared by both cache key layers,
@@ -238,28 +270,10 @@ func renderStepPNG(ctx context.Context, stepData []byte, camDir string, transpar
 // trimStepRenderMargins crops f3d's auto-fit padding. Opaque renders trim white
 // borders; transparent renders trim on the alpha channel.
 func trimStepRenderMargins(img *vips.ImageRef, transparent bool) error {
-	var left, top, tw, th int
-	var terr error
 	if transparent {
-		if !img.HasAlpha() {
-			return nil
-		}
-		alpha, err := img.ExtractBandToImage(img.Bands()-1, 1)
-		if err != nil {
-			return err
-		}
-		defer alpha.Close()
-		left, top, tw, th, terr = alpha.FindTrim(10, &vips.Color{R: 0, G: 0, B: 0})
-	} else {
-		left, top, tw, th, terr = img.FindTrim(10, &vips.Color{R: 255, G: 255, B: 255})
-	}
-	if terr != nil {
-		return terr
+		return trimBorders(img, defaultTrimThreshold, nil)
 	}
-	if tw > 0 && th > 0 && (tw < img.Width() || th < img.Height()) {
-		return img.ExtractArea(left, top, tw, th)
-	}
-	return nil
+	return trimBorders(img, defaultTrimThreshold, &vips.Color{R: 255, G: 255, B: 255})
 }
 
 // convertStepGLB converts STEP bytes to GLB via the step2glb helper.
@@ -0,0 +1,163 @@
+package handlers
+
+// Text overlays (badges, labels).
+//
+//   txt=SOLD%20OUT  - UTF-8 text, up to 200 characters
+//   txtsize=8..400  - font size in output pixels (scaled by dpr=), default
+//                     a tenth of the output width
+//   txtcolor=hex    - text color, default white
+//   txtg=<compass>  - position, default center
+//
+// Text is rendered with libvips (Pango) in the TEXT_FONT font, default
+// "sans bold" - any fontconfig family installed on the host. It wraps at the
+// output width and is composited after the color operations, below any
+// watermark. The cache key carries a hash of the text, not the text itself.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// TextFont is the Pango font family for txt= overlays (TEXT_FONT)
+var TextFont = "sans bold"
+
+// maxTextLength bounds txt= in characters
+const maxTextLength = 200
+
+// InitTextFont reads TEXT_FONT from environment. Must be called after
+// godotenv.Load().
+func InitTextFont() {
+	if f := strings.TrimSpace(os.Getenv("TEXT_FONT")); f != "" {
+		TextFont = f
+		log.Printf("Text overlay font: %s", TextFont)
+	}
+}
+
+// parseText parses txt=, txtsize=, txtcolor= and txtg= into params. The text
+// lands in the cache key as a 128-bit hash ("txt-1a2b...", long enough that
+// signatures can't be reused for another text), the other settings as their
+// own tokens when given.
+func parseText(q url.Values, params *ResizeParams) error {
+	txt := q.Get("txt")
+	if txt == "" {
+		for _, key := range []string{"txtsize", "txtcolor", "txtg"} {
+			if q.Get(key) != "" {
+				return fmt.Errorf("%s needs txt=", key)
+			}
+		}
+		return nil
+	}
+	if !utf8.ValidString(txt) || strings.IndexFunc(txt, unicode.IsControl) >= 0 {
+		return fmt.Errorf("invalid txt, use printable UTF-8 text")
+	}
+	if utf8.RuneCountInString(txt) > maxTextLength {
+		return fmt.Errorf("txt too long, max %d characters", maxTextLength)
+	}
+	params.Text = txt
+	sum := sha256.Sum256([]byte(txt))
+	params.appendCacheKey("txt-" + hex.EncodeToString(sum[:16]))
+
+	if s := q.Get("txtsize"); s != "" {
+		size, err := strconv.Atoi(s)
+		if err != nil || size < 8 || size > 400 {
+			return fmt.Errorf("invalid txtsize, use txtsize=8..400")
+		}
+		params.TextSize = size
+		params.appendCacheKey("txtsize" + strconv.Itoa(size))
+	}
+
+	params.TextColor = "ffffff"
+	if c := q.Get("txtcolor"); c != "" {
+		hexColor, ok := parseHexColor(c)
+		if !ok {
+			return fmt.Errorf("invalid txtcolor '%s', use a hex color", c)
+		}
+		params.TextColor = hexColor
+		params.appendCacheKey("txtcolor-" + hexColor)
+	}
+
+	params.TextGravity = "center"
+	if g := q.Get("txtg"); g != "" {
+		gravity, err := parseGravity(g)
+		if err != nil {
+			return err
+		}
+		if _, ok := gravityAnchors[gravity]; !ok {
+			return fmt.Errorf("invalid txtg '%s', use a compass gravity", g)
+		}
+		params.TextGravity = gravity
+		params.appendCacheKey("txtg-" + gravity)
+	}
+	return nil
+}
+
+// applyText renders the params' text and composites it onto img. Modifies in place.
+func applyText(img *vips.ImageRef, params *ResizeParams) error {
+	if params.Text == "" {
+		return nil
+	}
+
+	size := params.TextSize
+	if size == 0 {
+		size = max(img.Width()/10, 10)
+	} else if params.DPR > 1 {
+		size = int(math.Round(float64(size) * params.DPR))
+	}
+	margin := size / 2
+	wrapWidth := img.Width() - 2*margin
+	if wrapWidth < size {
+		return nil // output too small to carry the text
+	}
+
+	// vips_text takes Pango markup; escape so the text renders literally
+	mask, err := vips.Text(&vips.TextParams{
+		Text:      html.EscapeString(params.Text),
+		Font:      fmt.Sprintf("%s %d", TextFont, size),
+		Width:     wrapWidth,
+		DPI:       72, // font size in points = pixels
+		Alignment: vips.AlignCenter,
+	})
+	if err != nil {
+		return fmt.Errorf("text render: %v", err)
+	}
+	defer mask.Close()
+
+	// Solid color bands with the rendered glyph coverage as alpha
+	overlay, err := mask.Copy()
+	if err != nil {
+		return err
+	}
+	defer overlay.Close()
+	c := bgColor(params.TextColor)
+	if err := overlay.Linear1(0, float64(c.R)); err != nil {
+		return err
+	}
+	if err := overlay.BandJoinConst([]float64{float64(c.G), float64(c.B)}); err != nil {
+		return err
+	}
+	if err := overlay.BandJoin(mask); err != nil {
+		return err
+	}
+	if err := overlay.Cast(vips.BandFormatUchar); err != nil {
+		return err
+	}
+	srgb, err := overlay.CopyChangingInterpretation(vips.InterpretationSRGB)
+	if err != nil {
+		return err
+	}
+	defer srgb.Close()
+
+	return compositeOverlay(img, srgb, params.TextGravity, margin)
+}
@@ -0,0 +1,411 @@
+package handlers
+
+// Watermark overlays.
+//
+// Watermarks are registered by name in a JSON file (WATERMARKS_FILE, default
+// watermarks.json):
+//
+//   {"stock": {"src": "https://cdn.example.com/wm.png", "g": "se", "margin": 16,
+//              "scale": 0.25, "opacity": 0.7, "domains": ["*.stockpartner.com"]}}
+//
+// and requested with wm=<name>. src is a local file or a URL; URLs are fetched
+// once and kept in the image cache (key "watermark"). The watermark is scaled
+// to scale x the output width (default 0.2), placed at compass gravity g
+// (default se) inset by margin pixels, and blended at opacity (default 1).
+// Sources on a watermark's domains always get it, wm= or not.
+//
+// Compositing runs last, after the resize and the other operations. The
+// cache key carries "wm-<name>"; clear the cache after changing a watermark.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"image-resize/app/database"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Watermark is a registered watermark as configured in WATERMARKS_FILE
+type Watermark struct {
+	Src     string   `json:"src"`
+	Gravity string   `json:"g"`
+	Margin  int      `json:"margin"`
+	Scale   float64  `json:"scale"`
+	Opacity float64  `json:"opacity"`
+	Domains []string `json:"domains"`
+
+	data []byte // local file contents, nil for URLs
+}
+
+// WatermarkInfo describes a configured watermark for the admin dashboard
+type WatermarkInfo struct {
+	Name    string `json:"name"`
+	Src     string `json:"src"`
+	Domains string `json:"domains"`
+}
+
+// watermarks maps watermark name to its validated config
+var watermarks = map[string]*Watermark{}
+
+// watermarkFetchMu serializes remote watermark fetches so each is downloaded once
+var watermarkFetchMu sync.Mutex
+
+// watermarkCacheKey is the image cache key remote watermark assets live under
+const watermarkCacheKey = "watermark"
+
+// InitWatermarks loads watermarks from WATERMARKS_FILE (default
+// watermarks.json). Must be called after godotenv.Load(). A missing default
+// file is not an error.
+func InitWatermarks() {
+	path := os.Getenv("WATERMARKS_FILE")
+	explicit := path != ""
+	if !explicit {
+		path = "watermarks.json"
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if explicit || !os.IsNotExist(err) {
+			log.Printf("Failed to read watermarks file '%s': %v", path, err)
+		}
+		return
+	}
+
+	var raw map[string]Watermark
+	if err := json.Unmarshal(data, &raw); err != nil {
+		log.Printf("Invalid watermarks file '%s': %v", path, err)
+		return
+	}
+
+	if err := loadWatermarks(raw); err != nil {
+		log.Printf("Watermarks: %v", err)
+	}
+	log.Printf("Loaded %d watermarks from %s", len(watermarks), path)
+}
+
+// loadWatermarks validates and installs watermarks, filling in defaults.
+// Invalid entries are skipped and reported in the returned error.
+func loadWatermarks(raw map[string]Watermark) error {
+	watermarks = map[string]*Watermark{}
+
+	var bad []string
+	for name, wm := range raw {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !presetNamePattern.MatchString(name) {
+			bad = append(bad, fmt.Sprintf("'%s': invalid name", name))
+			continue
+		}
+		if err := validateWatermark(&wm); err != nil {
+			bad = append(bad, fmt.Sprintf("'%s': %v", name, err))
+			continue
+		}
+		watermarks[name] = &wm
+	}
+
+	if len(bad) > 0 {
+		sort.Strings(bad)
+		return fmt.Errorf("skipped invalid watermarks: %s", strings.Join(bad, "; "))
+	}
+	return nil
+}
+
+// validateWatermark checks a watermark config, applies defaults and reads
+// local source files.
+func validateWatermark(wm *Watermark) error {
+	if wm.Src == "" {
+		return fmt.Errorf("missing src")
+	}
+	if wm.Gravity == "" {
+		wm.Gravity = "se"
+	}
+	g, err := parseGravity(wm.Gravity)
+	if err != nil {
+		return err
+	}
+	if _, ok := gravityAnchors[g]; !ok {
+		return fmt.Errorf("g must be a compass gravity")
+	}
+	wm.Gravity = g
+	if wm.Scale == 0 {
+		wm.Scale = 0.2
+	}
+	if wm.Scale < 0 || wm.Scale > 1 {
+		return fmt.Errorf("scale must be 0..1")
+	}
+	if wm.Opacity == 0 {
+		wm.Opacity = 1
+	}
+	if wm.Opacity < 0 || wm.Opacity > 1 {
+		return fmt.Errorf("opacity must be 0..1")
+	}
+	if wm.Margin < 0 {
+		return fmt.Errorf("margin must be >= 0")
+	}
+	for i, d := range wm.Domains {
+		wm.Domains[i] = strings.ToLower(strings.TrimSpace(d))
+	}
+
+	if strings.HasPrefix(wm.Src, "http://") || strings.HasPrefix(wm.Src, "https://") {
+		return nil
+	}
+	data, err := os.ReadFile(wm.Src)
+	if err != nil {
+		return err
+	}
+	wm.data = data
+	return nil
+}
+
+// parseWatermark parses wm=<name> into params. Parsed last so an explicit
+// wm= and a domain-enforced one produce the same cache key.
+func parseWatermark(q url.Values, params *ResizeParams) error {
+	name := strings.ToLower(q.Get("wm"))
+	if name == "" {
+		return nil
+	}
+	if _, ok := watermarks[name]; !ok {
+		return fmt.Errorf("unknown watermark '%s'", name)
+	}
+	params.Watermark = name
+	params.appendCacheKey("wm-" + name)
+	return nil
+}
+
+// domainWatermark returns the watermark registered for the source's domain,
+// "" when none is.
+func domainWatermark(srcURL string) string {
+	if len(watermarks) == 0 {
+		return ""
+	}
+	parsed, err := url.Parse(srcURL)
+	if err != nil {
+		return ""
+	}
+	// "stockpartner.com." is the same host as "stockpartner.com"
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+
+	names := make([]string, 0, len(watermarks))
+	for name := range watermarks {
+		names = append(names, name)
+	}
+	sort.Strings(names) // deterministic when domains overlap
+	for _, name := range names {
+		for _, pattern := range watermarks[name].Domains {
+			if hostMatches(host, pattern) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// enforceWatermark adds the watermark registered for the source's domain.
+// A different wm= on such a source is an error rather than a way around it.
+func enforceWatermark(srcURL string, params *ResizeParams) error {
+	name := domainWatermark(srcURL)
+	if name == "" || params.Watermark == name {
+		return nil
+	}
+	if params.Watermark != "" {
+		return fmt.Errorf("source requires watermark '%s'", name)
+	}
+	params.Watermark = name
+	params.appendCacheKey("wm-" + name)
+	return nil
+}
+
+// watermarkData returns the watermark image bytes: local file contents, or
+// the remote asset from the image cache, downloading it on first use.
+func watermarkData(ctx context.Context, wm *Watermark) ([]byte, error) {
+	if wm.data != nil {
+		return wm.data, nil
+	}
+	if data, _, _, err := database.GetCachedImage(wm.Src, watermarkCacheKey); err == nil && data != nil {
+		return data, nil
+	}
+
+	watermarkFetchMu.Lock()
+	defer watermarkFetchMu.Unlock()
+	// Another request may have fetched it while we waited
+	if data, _, _, err := database.GetCachedImage(wm.Src, watermarkCacheKey); err == nil && data != nil {
+		return data, nil
+	}
+
+	data, contentType, err := downloadBytes(ctx, wm.Src)
+	if err != nil {
+		return nil, err
+	}
+	if err := database.CacheImage(wm.Src, watermarkCacheKey, data, contentType, watermarkCacheKey); err != nil {
+		log.Printf("Failed to cache watermark %s: %v", wm.Src, err)
+	} else {
+		log.Printf("Watermark cached for %s (%.1f KB)", wm.Src, float64(len(data))/1024.0)
+	}
+	return data, nil
+}
+
+// watermarkOverlay is a request's watermark, fetched and decoded once and
+// scaled once per output size, so animation frames share it.
+type watermarkOverlay struct {
+	wm            *Watermark
+	source        *vips.ImageRef // decoded watermark
+	mark          *vips.ImageRef // scaled for width x height, nil if it doesn't fit
+	width, height int            // output size mark was scaled for, 0 before
+}
+
+// loadWatermark fetches and decodes the params' watermark, nil when there is
+// none. The caller closes it.
+func loadWatermark(ctx context.Context, params *ResizeParams) (*watermarkOverlay, error) {
+	if params.Watermark == "" {
+		return nil, nil
+	}
+	wm, ok := watermarks[params.Watermark]
+	if !ok {
+		return nil, fmt.Errorf("unknown watermark '%s'", params.Watermark)
+	}
+	data, err := watermarkData(ctx, wm)
+	if err != nil {
+		return nil, fmt.Errorf("watermark fetch: %v", err)
+	}
+	source, err := vips.NewImageFromBuffer(data)
+	if err != nil {
+		return nil, fmt.Errorf("watermark decode: %v", err)
+	}
+	return &watermarkOverlay{wm: wm, source: source}, nil
+}
+
+// Close releases the decoded and scaled watermark. Safe on nil.
+func (o *watermarkOverlay) Close() {
+	if o == nil {
+		return
+	}
+	if o.mark != nil {
+		o.mark.Close()
+	}
+	o.source.Close()
+}
+
+// apply composites the watermark onto img, scaling it on first use and when
+// the output size changes. Modifies img in place. A nil overlay is a no-op.
+func (o *watermarkOverlay) apply(img *vips.ImageRef) error {
+	if o == nil {
+		return nil
+	}
+	if img.Width() != o.width || img.Height() != o.height {
+		if o.mark != nil {
+			o.mark.Close()
+			o.mark = nil
+		}
+		mark, err := o.scale(img.Width(), img.Height())
+		if err != nil {
+			return err
+		}
+		o.mark, o.width, o.height = mark, img.Width(), img.Height()
+	}
+	if o.mark == nil {
+		return nil // output too small to carry the watermark
+	}
+	return compositeOverlay(img, o.mark, o.wm.Gravity, o.wm.Margin)
+}
+
+// scale prepares a copy of the watermark for a width x height output: scaled
+// to the output width, shrunk further if it would overflow the height, sRGB
+// with alpha at the configured opacity. nil when the output is too small.
+func (o *watermarkOverlay) scale(width, height int) (*vips.ImageRef, error) {
+	wm := o.wm
+	availW := width - 2*wm.Margin
+	availH := height - 2*wm.Margin
+	if availW < 1 || availH < 1 {
+		return nil, nil
+	}
+	scale := math.Min(float64(width)*wm.Scale, float64(availW)) / float64(o.source.Width())
+	if h := float64(o.source.Height()) * scale; h > float64(availH) {
+		scale *= float64(availH) / h
+	}
+
+	mark, err := o.source.Copy()
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareMark(mark, scale, wm.Opacity); err != nil {
+		mark.Close()
+		return nil, err
+	}
+	return mark, nil
+}
+
+// prepareMark resizes a watermark copy and gives it an alpha band at opacity.
+// Modifies mark in place.
+func prepareMark(mark *vips.ImageRef, scale, opacity float64) error {
+	if err := mark.Resize(scale, vips.KernelLanczos3); err != nil {
+		return err
+	}
+	if mark.Bands() < 3 {
+		if err := mark.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+	if !mark.HasAlpha() {
+		if err := mark.AddAlpha(); err != nil {
+			return err
+		}
+	}
+	if opacity < 1 {
+		if err := mark.Linear([]float64{1, 1, 1, opacity}, []float64{0, 0, 0, 0}); err != nil {
+			return err
+		}
+		if err := mark.Cast(vips.BandFormatUchar); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compositeOverlay blends an sRGB + alpha overlay onto img at a compass
+// gravity, inset by margin pixels. Modifies img in place.
+func compositeOverlay(img, overlay *vips.ImageRef, gravity string, margin int) error {
+	if img.Bands() < 3 {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+	opaque := !img.HasAlpha()
+
+	anchor := gravityAnchors[gravity]
+	x := margin + int(float64(img.Width()-2*margin-overlay.Width())*anchor[0])
+	y := margin + int(float64(img.Height()-2*margin-overlay.Height())*anchor[1])
+	if err := img.Composite(overlay, vips.BlendModeOver, x, y); err != nil {
+		return err
+	}
+	// Composite adds an alpha band; an opaque base stays opaque
+	if opaque && img.HasAlpha() {
+		return img.ExtractBand(0, img.Bands()-1)
+	}
+	return nil
+}
+
+// ListWatermarks returns the configured watermarks sorted by name
+func ListWatermarks() []WatermarkInfo {
+	list := make([]WatermarkInfo, 0, len(watermarks))
+	for name, wm := range watermarks {
+		list = append(list, WatermarkInfo{Name: name, Src: wm.Src, Domains: strings.Join(wm.Domains, ", ")})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// LoadWatermarksForTest installs watermarks for tests
+func LoadWatermarksForTest(raw map[string]Watermark) error {
+	return loadWatermarks(raw)
+}
+
+// DomainWatermarkForTest exposes domainWatermark for tests
+func DomainWatermarkForTest(srcURL string) string { return domainWatermark(srcURL) }
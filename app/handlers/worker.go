@@ -34,6 +34,7 @@ type ResizeJob struct {
 	SrcURL   string
 	Params   *ResizeParams
 	CacheKey string
+	UseJXL   bool
 	UseAVIF  bool
 	UseWebP  bool
 }
@@ -54,14 +55,22 @@ type workerTask struct {
 // sourceResult tracks an in-progress source fetch.
 // Multiple workers needing the same source URL share the same entry.
 // data holds the source bytes (already size-clamped, possibly re-encoded as AVIF
-// for compactness when stored in the DB cache). For SVG passthrough, isSVG is
-// true and data is the raw SVG bytes.
+// for compactness when stored in the DB cache, animated WebP for animations).
+// For SVG passthrough, isSVG is true and data is the raw SVG bytes.
 type sourceResult struct {
 	done   chan struct{}
 	data   []byte
-	format string // original format: "jpeg", "png", "webp", "avif", "gif", "svg"
+	format string // original format: "jpeg", "png", "webp", "avif", "heic", "gif", "svg"
 	isSVG  bool
 	err    error
+
+	animated bool // data is an animated WebP (animated GIF/WebP sources)
+	pages    int  // page count of PDF/TIFF sources, 0 for other images
+
+	// Original image size before enforceMaxSize (after EXIF orientation),
+	// 0 when unknown: SVG, STEP renders, sources cached before it was recorded
+	origWidth  int
+	origHeight int
 }
 
 // WorkerPool manages a fixed number of resize worker goroutines
@@ -150,7 +159,7 @@ func (p *WorkerPool) processTask(task *workerTask) {
 	if task.job.Params.Format == "glb" {
 		result = fetchAndConvertGLB(ctx, task.job.SrcURL)
 	} else {
-		result = fetchAndResize(ctx, task.job.SrcURL, task.job.Params, task.job.UseAVIF, task.job.UseWebP)
+		result = fetchAndResize(ctx, task.job.SrcURL, task.job.Params, task.job.UseJXL, task.job.UseAVIF, task.job.UseWebP)
 	}
 	cancel()
 
@@ -159,7 +168,7 @@ func (p *WorkerPool) processTask(task *workerTask) {
 
 	if result.Err == nil && result.Format != "svg" {
 		p := task.job.Params
-		if p.Width > 0 || p.Height > 0 || p.Format != "" {
+		if p.CacheKey != "" || p.Format != "" {
 			go func() {
 				if err := database.CacheImage(task.job.SrcURL, task.job.CacheKey, result.Data, result.ContentType, result.Format); err != nil {
 					log.Printf("Failed to cache resized image: %v", err)
@@ -181,22 +190,23 @@ func (p *WorkerPool) processTask(task *workerTask) {
 // coalesced - only one goroutine fetches.
 //
 // STEP sources are rendered to an image via f3d; the render is cached per
-// camera direction and background (camDir/camKey/bgKey from params).
-func (p *WorkerPool) ensureSource(ctx context.Context, srcURL, camDir, camKey, bgKey string, bgTransparent bool) *sourceResult {
-	sourceKey := "source"
+// camera direction and background (params.CamDir/CamKey/BgKey). Documents are
+// cached per page and density (params.Page/Density).
+func (p *WorkerPool) ensureSource(ctx context.Context, srcURL string, params *ResizeParams) *sourceResult {
+	sourceKey := documentSourceCacheKey(params.Page, params.Density)
 	isStep := isStepSource(srcURL)
 	if isStep {
-		sourceKey = stepSourceCacheKey(camKey, bgKey)
+		sourceKey = stepSourceCacheKey(params.CamKey, params.BgKey)
 	}
 
 	// 1. Check DB cache for source
-	cachedData, _, cachedFormat, err := database.GetCachedImage(srcURL, sourceKey)
+	cachedData, meta, err := database.GetCachedSource(srcURL, sourceKey)
 	if err == nil && cachedData != nil {
-		log.Printf("Source cache HIT for %s (key: %s, format: %s)", srcURL, sourceKey, cachedFormat)
-		if cachedFormat == "svg" {
+		log.Printf("Source cache HIT for %s (key: %s, format: %s)", srcURL, sourceKey, meta.Format)
+		if meta.Format == "svg" {
 			return &sourceResult{isSVG: true, data: cachedData, format: "svg"}
 		}
-		return &sourceResult{data: cachedData, format: cachedFormat}
+		return &sourceResult{data: cachedData, format: meta.Format, origWidth: meta.OrigWidth, origHeight: meta.OrigHeight, pages: meta.Pages}
 	}
 
 	// 2. Coalesce concurrent source fetches for the same URL + source key
@@ -217,9 +227,9 @@ func (p *WorkerPool) ensureSource(ctx context.Context, srcURL, camDir, camKey, b
 
 	// 3. We're the first - fetch from remote (STEP: fetch raw + render)
 	if isStep {
-		renderStepSource(ctx, p, srcURL, camDir, bgTransparent, entry)
+		renderStepSource(ctx, p, srcURL, params.CamDir, params.BgTransparent, entry)
 	} else {
-		fetchSourceRemote(ctx, srcURL, entry)
+		fetchSourceRemote(ctx, srcURL, params.Page, params.Density, entry)
 	}
 
 	// 4. Notify all waiting workers (they can start resizing immediately)
@@ -232,8 +242,11 @@ func (p *WorkerPool) ensureSource(ctx context.Context, srcURL, camDir, camKey, b
 			mime = "image/svg+xml"
 		} else if isStep {
 			mime = "image/webp" // STEP renders are cached as lossless WebP
+		} else if entry.animated {
+			mime = "image/webp"
 		}
-		if err := database.CacheImage(srcURL, sourceKey, entry.data, mime, entry.format); err != nil {
+		meta := database.SourceMeta{Format: entry.format, OrigWidth: entry.origWidth, OrigHeight: entry.origHeight, Pages: entry.pages}
+		if err := database.CacheSource(srcURL, sourceKey, entry.data, mime, meta); err != nil {
 			log.Printf("Failed to cache source: %v", err)
 		} else if !entry.isSVG {
 			log.Printf("Source cached for %s (key: %s, original: %s, stored as %s, %.1f KB)",
@@ -282,10 +295,43 @@ func isRasterMagic(b []byte) bool {
 	if b[0] == 'B' && b[1] == 'M' {
 		return true
 	}
-	if string(b[4:8]) == "ftyp" {
-		return true
+	// ISO BMFF: only HEIF images, not MP4/MOV video that shares the ftyp box
+	return heifBrand(b) != ""
+}
+
+// heifBrands maps ftyp brands of HEIF still images to the source format. mif1
+// and msf1 are generic HEIF brands shared by AVIF and HEIC files.
+var heifBrands = map[string]string{
+	"avif": "avif", "avis": "avif",
+	"heic": "heic", "heix": "heic", "heim": "heic", "heis": "heic",
+	"hevc": "heic", "hevx": "heic", "mif1": "heif", "msf1": "heif",
+}
+
+// heifBrand tells AVIF from HEIC by the ftyp box: "avif", "heic" or "" when
+// b isn't a HEIF image. libvips loads both through heifload, so the loader
+// can't tell them apart. Generic mif1/msf1 files are decided by their
+// compatible brands and default to HEIC (HEVC is what phones write).
+func heifBrand(b []byte) string {
+	if len(b) < 12 || string(b[4:8]) != "ftyp" {
+		return ""
 	}
-	return false
+	major, ok := heifBrands[string(b[8:12])]
+	if !ok {
+		return ""
+	}
+	if major != "heif" {
+		return major
+	}
+
+	// size, "ftyp", major brand, minor version, then compatible brands
+	size := int(b[0])<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	size = min(size, len(b))
+	for i := 16; i+4 <= size; i += 4 {
+		if f := heifBrands[string(b[i:i+4])]; f != "" && f != "heif" {
+			return f
+		}
+	}
+	return "heic"
 }
 
 func isSVGBytes(b []byte) bool {
@@ -307,6 +353,11 @@ func urlPathIsSVG(srcURL string) bool {
 	return strings.HasSuffix(strings.ToLower(path), ".svg")
 }
 
+// HeifBrandForTest exposes heifBrand for tests.
+func HeifBrandForTest(b []byte) string {
+	return heifBrand(b)
+}
+
 // IsSVGSourceForTest exposes isSVGSource for tests.
 func IsSVGSourceForTest(contentType, srcURL string, body []byte) bool {
 	return isSVGSource(contentType, srcURL, body)
@@ -351,8 +402,9 @@ func downloadBytes(ctx context.Context, srcURL string) ([]byte, string, error) {
 
 // fetchSourceRemote downloads an image from a remote URL, decodes it via vips,
 // enforces max size, re-encodes as AVIF for compact caching, and populates
-// the sourceResult entry. SVG bypasses decode and is stored verbatim.
-func fetchSourceRemote(ctx context.Context, srcURL string, entry *sourceResult) {
+// the sourceResult entry. SVG bypasses decode and is stored verbatim. PDF and
+// TIFF documents are rendered at the given page and density.
+func fetchSourceRemote(ctx context.Context, srcURL string, page, density int, entry *sourceResult) {
 	bodyBytes, contentType, err := downloadBytes(ctx, srcURL)
 	if err != nil {
 		entry.err = err
@@ -381,23 +433,43 @@ func fetchSourceRemote(ctx context.Context, srcURL string, entry *sourceResult)
 		bodyBytes = png
 	}
 
-	img, err := vips.NewImageFromBuffer(bodyBytes)
+	var img *vips.ImageRef
+	if f := formatName(vips.DetermineImageType(bodyBytes)); density > 0 && f != "pdf" {
+		// Would only duplicate the source and its variants under another key
+		err = fmt.Errorf("density-failed; density= applies to PDF sources only")
+	} else if isDocument(f) {
+		img, entry.pages, err = loadDocumentPage(bodyBytes, f, page, density)
+	} else if page > 1 {
+		err = fmt.Errorf("page-failed; page %d of a single image", page)
+	} else if img, err = vips.NewImageFromBuffer(bodyBytes); err != nil {
+		err = fmt.Errorf("decode-failed; %v", err)
+	}
 	if err != nil {
-		entry.err = fmt.Errorf("decode-failed; %v", err)
+		entry.err = err
 		return
 	}
 	defer img.Close()
 
 	origFormat := formatName(img.OriginalFormat())
+	if brand := heifBrand(bodyBytes); brand != "" {
+		origFormat = brand
+	}
 
-	// GIF: skip vips re-encode (only first frame survives the export round-trip
-	// and we want to keep the GIF passthrough behavior). Cache the original bytes.
-	if origFormat == "gif" {
-		entry.data = bodyBytes
-		entry.format = "gif"
+	// Animated GIF/WebP: reload with every frame and cache as animated WebP
+	// (AVIF holds a single frame)
+	if isAnimatable(origFormat) && img.Pages() > 1 {
+		fetchAnimatedSource(bodyBytes, origFormat, entry)
 		return
 	}
 
+	// Apply EXIF orientation before the metadata is stripped by the AVIF
+	// re-encode, otherwise phone photos are cached sideways
+	if err := img.AutoRotate(); err != nil {
+		entry.err = fmt.Errorf("decode-failed; autorotate: %v", err)
+		return
+	}
+	entry.origWidth, entry.origHeight = img.Width(), img.Height()
+
 	if err := enforceMaxSize(img); err != nil {
 		entry.err = fmt.Errorf("resize-failed; %v", err)
 		return
@@ -414,20 +486,49 @@ func fetchSourceRemote(ctx context.Context, srcURL string, entry *sourceResult)
 	entry.format = origFormat
 }
 
+// fetchAnimatedSource decodes every frame of an animated source, caps the
+// frame size at MaxSize and populates entry with an animated WebP.
+func fetchAnimatedSource(bodyBytes []byte, origFormat string, entry *sourceResult) {
+	importParams := vips.NewImportParams()
+	importParams.NumPages.Set(-1)
+	img, err := vips.LoadImageFromBuffer(bodyBytes, importParams)
+	if err != nil {
+		entry.err = fmt.Errorf("decode-failed; %v", err)
+		return
+	}
+	defer img.Close()
+	entry.origWidth, entry.origHeight = img.Width(), img.PageHeight()
+
+	if err := enforceMaxSizeAnimated(img); err != nil {
+		entry.err = fmt.Errorf("resize-failed; %v", err)
+		return
+	}
+
+	data, err := encodeWebP(img, AVIFQuality)
+	if err != nil {
+		entry.err = fmt.Errorf("source-encode-failed; %v", err)
+		return
+	}
+	entry.data = data
+	entry.format = origFormat
+	entry.animated = true
+}
+
 // ---------------------------------------------------------------------------
 // fetchAndResize: uses ensureSource for source caching + coalescing
 // ---------------------------------------------------------------------------
 
 // fetchAndResize gets the source image (from cache or remote), resizes, and encodes.
 // Respects the provided context for cancellation/timeout.
-func fetchAndResize(ctx context.Context, srcURL string, params *ResizeParams, useAVIF, useWebP bool) *ResizeResult {
-	source := pool.ensureSource(ctx, srcURL, params.CamDir, params.CamKey, params.BgKey, params.BgTransparent)
+func fetchAndResize(ctx context.Context, srcURL string, params *ResizeParams, useJXL, useAVIF, useWebP bool) *ResizeResult {
+	source := pool.ensureSource(ctx, srcURL, params)
 	if source.err != nil {
 		return &ResizeResult{Err: source.err}
 	}
 
-	// SVG passthrough - unless a format is forced, then rasterize via vips below
-	if source.isSVG && params.Format == "" {
+	// SVG passthrough - unless a format is forced or a watermark applies, then
+	// rasterize via vips below
+	if source.isSVG && params.Format == "" && params.Watermark == "" {
 		return &ResizeResult{
 			Data:        source.data,
 			ContentType: "image/svg+xml",
@@ -436,7 +537,7 @@ func fetchAndResize(ctx context.Context, srcURL string, params *ResizeParams, us
 		}
 	}
 
-	img, err := vips.NewImageFromBuffer(source.data)
+	img, err := loadSourceImage(source, params)
 	if err != nil {
 		return &ResizeResult{Err: fmt.Errorf("source-decode-failed; %v", err)}
 	}
@@ -444,22 +545,32 @@ func fetchAndResize(ctx context.Context, srcURL string, params *ResizeParams, us
 
 	format := source.format
 
-	// Premultiply around the resample: transparent pixels carry black RGB (f3d
-	// renders, most alpha PNGs), which bleeds into the edges of a straight
-	// non-premultiplied downscale and leaves a dark fringe.
-	if img.HasAlpha() {
-		if err := img.PremultiplyAlpha(); err != nil {
-			return &ResizeResult{Err: fmt.Errorf("premultiply-failed; %v", err)}
-		}
-	}
-	if err := resizeImage(img, params); err != nil {
-		return &ResizeResult{Err: fmt.Errorf("resize-failed; %v", err)}
+	// Loaded once, animations reuse it for every frame
+	overlay, err := loadWatermark(ctx, params)
+	if err != nil {
+		return &ResizeResult{Err: fmt.Errorf("watermark-failed; %v", err)}
 	}
-	// No-op unless premultiplied above; restores the original band format
-	if err := img.UnpremultiplyAlpha(); err != nil {
-		return &ResizeResult{Err: fmt.Errorf("unpremultiply-failed; %v", err)}
+	defer overlay.Close()
+
+	frames := frameCount(img)
+	var upscale string
+	if frames > 1 {
+		anim, aupscale, err := processAnimation(ctx, img, source, params, overlay)
+		if err != nil {
+			return &ResizeResult{Err: err}
+		}
+		defer anim.Close()
+		img, upscale = anim, aupscale
+		frames = frameCount(img)
+	} else if upscale, err = processImage(img, source, params, overlay); err != nil {
+		return &ResizeResult{Err: err}
 	}
 
+	// Effective pixel size, reported in X-Info (dpr multiplies, clamps and the
+	// no-upscale rule may shrink it); animations report the frame size
+	outWidth, outHeight := img.Width(), img.PageHeight()
+
+	quality := params.encodeQuality()
 	var (
 		outputData   []byte
 		mimeType     string
@@ -468,11 +579,32 @@ func fetchAndResize(ctx context.Context, srcURL string, params *ResizeParams, us
 
 	switch {
 	case params.Format != "":
-		outputData, mimeType, outputFormat, err = encodeForced(params.Format, img)
+		outputData, mimeType, outputFormat, err = encodeForced(params.Format, img, params)
 		if err != nil {
 			return &ResizeResult{Err: fmt.Errorf("encode-failed; %v", err)}
 		}
-	case format == "gif":
+	case frames > 1:
+		// Animations stay animated: AVIF where supported, WebP, GIF otherwise
+		if useAVIF && AnimatedAVIF {
+			outputData, err = encodeAVIF(img, quality)
+			mimeType, outputFormat = "image/avif", "avif"
+			if err != nil {
+				log.Printf("Animated AVIF failed (%v), trying WebP", err)
+			}
+		}
+		if outputData == nil && useWebP {
+			outputData, err = encodeWebP(img, quality)
+			mimeType, outputFormat = "image/webp", "webp"
+		}
+		if outputData == nil {
+			outputData, err = encodeGIF(img)
+			mimeType, outputFormat = "image/gif", "gif"
+		}
+		if err != nil {
+			return &ResizeResult{Err: fmt.Errorf("anim-encode-failed; %v", err)}
+		}
+	case format == "gif" && !params.Still:
+		// anim=0 negotiates like any still below
 		mimeType = "image/gif"
 		outputFormat = "gif"
 		outputData, err = encodeGIF(img)
@@ -480,9 +612,38 @@ func fetchAndResize(ctx context.Context, srcURL string, params *ResizeParams, us
 			log.Printf("GIF encode failed: %v", err)
 			return &ResizeResult{Err: fmt.Errorf("gif-encode-failed; %v", err)}
 		}
+	case useJXL:
+		data, jerr := encodeJXL(img, quality)
+		if jerr == nil {
+			outputData = data
+			mimeType = "image/jxl"
+			outputFormat = "jxl"
+			break
+		}
+		log.Printf("JXL failed (%v), falling back", jerr)
+		if useAVIF {
+			if data, aerr := encodeAVIF(img, quality); aerr == nil {
+				outputData = data
+				mimeType = "image/avif"
+				outputFormat = "avif"
+				break
+			}
+		}
+		if useWebP {
+			if data, werr := encodeWebP(img, quality); werr == nil {
+				outputData = data
+				mimeType = "image/webp"
+				outputFormat = "webp"
+				break
+			}
+		}
+		outputData, mimeType, outputFormat, err = encodeFallback(format, img, params)
+		if err != nil {
+			return &ResizeResult{Err: fmt.Errorf("encode-failed; %v", err)}
+		}
 	case useAVIF:
 		log.Printf("Attempting AVIF encoding for format: %s", format)
-		data, aerr := encodeAVIF(img, AVIFQuality)
+		data, aerr := encodeAVIF(img, quality)
 		if aerr == nil {
 			log.Printf("AVIF encoding successful, output size: %.1f KB", float64(len(data))/1024.0)
 			outputData = data
@@ -490,28 +651,28 @@ func fetchAndResize(ctx context.Context, srcURL string, params *ResizeParams, us
 			outputFormat = "avif"
 		} else if useWebP {
 			log.Printf("AVIF failed (%v), trying WebP", aerr)
-			data, werr := encodeWebP(img, AVIFQuality)
+			data, werr := encodeWebP(img, quality)
 			if werr == nil {
 				outputData = data
 				mimeType = "image/webp"
 				outputFormat = "webp"
 			} else {
 				log.Printf("WebP encoding also failed (%v), falling back", werr)
-				outputData, mimeType, outputFormat, err = encodeFallback(format, img)
+				outputData, mimeType, outputFormat, err = encodeFallback(format, img, params)
 				if err != nil {
 					return &ResizeResult{Err: fmt.Errorf("encode-failed; %v", err)}
 				}
 			}
 		} else {
 			log.Printf("AVIF failed (%v), falling back", aerr)
-			outputData, mimeType, outputFormat, err = encodeFallback(format, img)
+			outputData, mimeType, outputFormat, err = encodeFallback(format, img, params)
 			if err != nil {
 				return &ResizeResult{Err: fmt.Errorf("encode-failed; %v", err)}
 			}
 		}
 	case useWebP:
 		log.Printf("Attempting WebP encoding for format: %s", format)
-		data, werr := encodeWebP(img, AVIFQuality)
+		data, werr := encodeWebP(img, quality)
 		if werr == nil {
 			log.Printf("WebP encoding successful, output size: %.1f KB", float64(len(data))/1024.0)
 			outputData = data
@@ -519,24 +680,85 @@ func fetchAndResize(ctx context.Context, srcURL string, params *ResizeParams, us
 			outputFormat = "webp"
 		} else {
 			log.Printf("WebP encoding failed (%v), falling back", werr)
-			outputData, mimeType, outputFormat, err = encodeFallback(format, img)
+			outputData, mimeType, outputFormat, err = encodeFallback(format, img, params)
 			if err != nil {
 				return &ResizeResult{Err: fmt.Errorf("encode-failed; %v", err)}
 			}
 		}
 	default:
-		outputData, mimeType, outputFormat, err = encodeFallback(format, img)
+		outputData, mimeType, outputFormat, err = encodeFallback(format, img, params)
 		if err != nil {
 			return &ResizeResult{Err: fmt.Errorf("encode-failed; %v", err)}
 		}
 	}
 
+	info := fmt.Sprintf("source-cache; params=%s; input=%s; output=%s; size=%dx%d", params.CacheKey, format, outputFormat, outWidth, outHeight)
+	// Only reported when the target exceeds the source
+	if upscale != "" {
+		info += "; upscale=" + upscale
+	}
+	if frames > 1 {
+		info += fmt.Sprintf("; frames=%d", frames)
+	}
+	if source.pages > 0 {
+		info += fmt.Sprintf("; pages=%d", source.pages)
+	}
+
 	return &ResizeResult{
 		Data:        outputData,
 		ContentType: mimeType,
 		Format:      outputFormat,
-		Info:        fmt.Sprintf("source-cache; params=%s; input=%s; output=%s", params.CacheKey, format, outputFormat),
+		Info:        info,
+	}
+}
+
+// processImage runs the per-image pipeline on a decoded source: region,
+// orientation, resize, filters, color and overlays. Animations run it per
+// frame, sharing one loaded watermark overlay (nil for none). Returns the
+// upscale state for X-Info. Modifies img in place.
+func processImage(img *vips.ImageRef, source *sourceResult, params *ResizeParams, overlay *watermarkOverlay) (string, error) {
+	if err := extractRect(img, source.origWidth, source.origHeight, params); err != nil {
+		return "", fmt.Errorf("rect-failed; %v", err)
+	}
+	if err := applyTrim(img, params); err != nil {
+		return "", fmt.Errorf("trim-failed; %v", err)
+	}
+	if err := applyOrientation(img, params); err != nil {
+		return "", fmt.Errorf("rotate-failed; %v", err)
+	}
+
+	// Premultiply around the resample: transparent pixels carry black RGB (f3d
+	// renders, most alpha PNGs), which bleeds into the edges of a straight
+	// non-premultiplied downscale and leaves a dark fringe.
+	if img.HasAlpha() {
+		if err := img.PremultiplyAlpha(); err != nil {
+			return "", fmt.Errorf("premultiply-failed; %v", err)
+		}
+	}
+	upscale, err := resizeImage(img, params)
+	if err != nil {
+		return "", fmt.Errorf("resize-failed; %v", err)
+	}
+	if err := applyBlur(img, params); err != nil {
+		return upscale, fmt.Errorf("blur-failed; %v", err)
+	}
+	// No-op unless premultiplied above; restores the original band format
+	if err := img.UnpremultiplyAlpha(); err != nil {
+		return upscale, fmt.Errorf("unpremultiply-failed; %v", err)
+	}
+	if err := applySharpen(img, params); err != nil {
+		return upscale, fmt.Errorf("sharpen-failed; %v", err)
+	}
+	if err := applyColorOps(img, params); err != nil {
+		return upscale, fmt.Errorf("adjust-failed; %v", err)
+	}
+	if err := applyText(img, params); err != nil {
+		return upscale, fmt.Errorf("text-failed; %v", err)
+	}
+	if err := overlay.apply(img); err != nil {
+		return upscale, fmt.Errorf("watermark-failed; %v", err)
 	}
+	return upscale, nil
 }
 
 // ---------------------------------------------------------------------------
@@ -29,6 +29,22 @@ func main() {
 	// Initialize allowed domains (must be after .env load)
 	handlers.InitAllowedDomains()
 
+	// Initialize upscale policy, q= bounds and JPEG/PNG encoder defaults
+	// (must be after .env load, before presets)
+	handlers.InitUpscale()
+	handlers.InitQualityBounds()
+	handlers.InitEncodeOptions()
+	handlers.InitClientHints()
+
+	// Initialize URL signing (must be after .env load)
+	handlers.InitSigning()
+
+	// Text overlay font (must be after .env load)
+	handlers.InitTextFont()
+
+	// Load watermarks (must be after .env load, before presets)
+	handlers.InitWatermarks()
+
 	// Resolve external STEP tool binaries (must be after .env load)
 	handlers.InitStepTools()
 
@@ -50,6 +66,14 @@ func main() {
 	vips.Startup(nil)
 	defer vips.Shutdown()
 
+	// Probe encoder support (needs libvips): animated AVIF, JPEG XL
+	handlers.InitAnimatedAVIF()
+	handlers.InitJXL()
+
+	// Load named resize presets (must be after the encoder probes, presets
+	// may force f=jxl)
+	handlers.InitPresets()
+
 	// Start resize worker pool (reads WORKERS env, default 5)
 	handlers.StartWorkerPool(0)
 
@@ -69,6 +93,8 @@ func main() {
 	mux.HandleFunc("/config/toggle-domain", handlers.BasicAuth(handlers.ToggleDomainHandler))
 	mux.HandleFunc("/config/clear-cache", handlers.BasicAuth(handlers.ClearCacheHandler))
 	mux.HandleFunc("/config/delete-cache-item", handlers.BasicAuth(handlers.DeleteCacheItemHandler))
+	mux.HandleFunc("/config/sign-url", handlers.BasicAuth(handlers.SignURLHandler))
+	mux.HandleFunc("/srcset", handlers.BasicAuth(handlers.SrcsetHandler))
 	mux.HandleFunc("/cache", handlers.BasicAuth(handlers.CacheExplorerHandler))
 	mux.HandleFunc("/cache/preview", handlers.BasicAuth(handlers.CachePreviewHandler))
 	mux.HandleFunc("/logs", handlers.BasicAuth(handlers.LogsHandler))
@@ -12,10 +12,11 @@ type Image struct {
 	Height   int
 	Format   string
 	FileSize int64
+	Pages    int
 }
 
 func NewImage(src string) (*Image, error) {
-	img := &Image{Source: src}
+	img := &Image{Source: src, Pages: 1}
 
 	file, err := os.Open(src)
 	if err != nil {
@@ -48,6 +49,7 @@ func (img *Image) GetProperties() map[string]interface{} {
 		"height":   img.Height,
 		"format":   img.Format,
 		"fileSize": img.FileSize,
+		"pages":    img.Pages,
 		"filename": filepath.Base(img.Source),
 	}
 }
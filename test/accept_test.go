@@ -0,0 +1,121 @@
+package test
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"image-resize/app/handlers"
+)
+
+func TestNegotiateFormats(t *testing.T) {
+	cases := []struct {
+		name   string
+		accept string
+		want   []string
+	}{
+		{"chrome", "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", []string{"avif", "webp"}},
+		{"firefox", "image/avif,image/webp,*/*", []string{"avif", "webp"}},
+		{"safari", "image/webp,image/avif,image/jxl,image/heic,image/heic-sequence,video/*;q=0.8,image/png,image/svg+xml,image/*;q=0.8,*/*;q=0.5", []string{"avif", "webp"}},
+		// pre-AVIF Chrome: image/* must not imply AVIF support
+		{"old chrome", "image/webp,image/apng,image/*,*/*;q=0.8", []string{"webp"}},
+		{"googlebot", "*/*", nil},
+		{"curl", "", nil},
+		{"wildcard only", "image/*;q=0.8", nil},
+		{"bare star", "*", nil},
+		// crawler that can't decode AVIF says so explicitly
+		{"avif refused", "image/avif;q=0,image/webp,*/*", []string{"webp"}},
+		{"client prefers webp", "image/webp;q=0.9,image/avif;q=0.5", []string{"webp", "avif"}},
+		{"case and spaces", " IMAGE/AVIF ; Q=0.7 , image/webp;q=0.7", []string{"avif", "webp"}},
+		{"invalid q skipped", "image/avif;q=abc,image/webp;q=2,image/webp;q=0.5", []string{"webp"}},
+		// Googlebot renders with evergreen Chromium and sends its image Accept
+		{"googlebot chromium", "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", []string{"avif", "webp"}},
+		// IE 11 / legacy crawlers: PNG listed, nothing modern
+		{"legacy crawler", "image/png,image/svg+xml,image/*;q=0.8,*/*;q=0.5", nil},
+		// image/* ranks the fallback: formats rated below it are dropped
+		{"original preferred", "image/webp;q=0.5,image/*", nil},
+		{"jpeg over avif", "image/avif;q=0.5,image/webp,image/jpeg", []string{"webp"}},
+		{"fallback refused", "image/avif;q=0.5,image/*;q=0", []string{"avif"}},
+		{"star ranks fallback", "image/webp;q=0.5,*/*", nil},
+	}
+	for _, c := range cases {
+		if got := handlers.NegotiateFormatsForTest(c.accept); !reflect.DeepEqual(got, c.want) && (len(got) > 0 || len(c.want) > 0) {
+			t.Errorf("%s: negotiateFormats(%q) = %v, want %v", c.name, c.accept, got, c.want)
+		}
+	}
+}
+
+func TestAcceptNegotiationE2E(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg"
+
+	cases := []struct {
+		accept   string
+		wantType string
+	}{
+		{"image/avif;q=0,image/webp,*/*", "image/webp"},
+		{"image/webp;q=0.9,image/avif;q=0.5", "image/webp"},
+		{"image/avif,image/webp,*/*", "image/avif"},
+		{"image/*,*/*;q=0.8", "image/jpeg"},
+		{"image/webp;q=0.5,image/*", "image/jpeg"},
+		{"image/png,image/svg+xml,image/*;q=0.8,*/*;q=0.5", "image/jpeg"},
+	}
+	for _, c := range cases {
+		rec := resizeGet("/r/w48?"+src, c.accept)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q: code=%d body=%q", c.accept, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Content-Type"); got != c.wantType {
+			t.Errorf("Accept %q: type=%q, want %q", c.accept, got, c.wantType)
+		}
+	}
+}
+
+func TestJXLNegotiation(t *testing.T) {
+	defer handlers.SetJXLForTest(false, true)
+
+	safari := "image/webp,image/avif,image/jxl,image/heic,image/heic-sequence,video/*;q=0.8,image/png,image/svg+xml,image/*;q=0.8,*/*;q=0.5"
+	chrome := "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8"
+	cases := []struct {
+		name       string
+		enabled    bool
+		beforeAVIF bool
+		accept     string
+		want       []string
+	}{
+		{"disabled", false, true, safari, []string{"avif", "webp"}},
+		{"before avif", true, true, safari, []string{"jxl", "avif", "webp"}},
+		{"after avif", true, false, safari, []string{"avif", "jxl", "webp"}},
+		{"not accepted", true, true, chrome, []string{"avif", "webp"}},
+		{"client prefers jxl", true, false, "image/avif;q=0.8,image/jxl", []string{"jxl", "avif"}},
+	}
+	for _, c := range cases {
+		handlers.SetJXLForTest(c.enabled, c.beforeAVIF)
+		if got := handlers.NegotiateFormatsForTest(c.accept); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: negotiateFormats = %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	// Forcing JXL without an encoder is a clean 400
+	handlers.SetJXLForTest(false, true)
+	ts := imageServer()
+	defer ts.Close()
+	for _, target := range []string{"/r/w48.jxl?", "/r/w48&f=jxl?"} {
+		if rec := resizeGet(target+ts.URL+"/test.jpeg", ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s with JXL disabled: code=%d, want 400", target, rec.Code)
+		}
+	}
+	if rec, _ := srcsetGet(t, "url="+url.QueryEscape(ts.URL+"/test.jpeg")+"&widths=48&f=jxl"); rec.Code != http.StatusBadRequest {
+		t.Errorf("srcset f=jxl with JXL disabled: code=%d, want 400", rec.Code)
+	}
+
+	// A JXL client whose JXL encode fails (libvips without the encoder) gets
+	// AVIF, its next choice, not WebP
+	handlers.SetJXLForTest(true, true)
+	rec := resizeGet("/r/w48&q=71?"+ts.URL+"/test.jpeg", safari)
+	if ct := rec.Header().Get("Content-Type"); ct != "image/jxl" && ct != "image/avif" {
+		t.Errorf("jxl client: type=%q (info %q), want image/jxl or image/avif", ct, rec.Header().Get("X-Info"))
+	}
+}
@@ -0,0 +1,167 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"image-resize/app/handlers"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// animColors are the frame colors of createAnimatedGIF
+var animColors = []color.RGBA{{R: 255, A: 255}, {G: 255, A: 255}, {B: 255, A: 255}}
+
+// createAnimatedGIF encodes a solid red, green, blue animation with 10, 20
+// and 30 centisecond delays.
+func createAnimatedGIF(width, height int) []byte {
+	anim := &gif.GIF{}
+	for i, c := range animColors {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{c})
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10*(i+1))
+	}
+	var buf bytes.Buffer
+	gif.EncodeAll(&buf, anim)
+	return buf.Bytes()
+}
+
+func animServer() *httptest.Server {
+	data := createAnimatedGIF(300, 200)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(data)
+	}))
+}
+
+func TestAnimatedGIF(t *testing.T) {
+	ts := animServer()
+	defer ts.Close()
+	src := ts.URL + "/anim.gif"
+
+	rec := resizeGet("/r/w150?"+src, "image/avif,image/*")
+	if ct := rec.Header().Get("Content-Type"); ct != "image/gif" {
+		t.Fatalf("content-type %q (info %q), want image/gif", ct, rec.Header().Get("X-Info"))
+	}
+	if info := rec.Header().Get("X-Info"); !strings.Contains(info, "frames=3") || !strings.Contains(info, "size=150x100") {
+		t.Errorf("X-Info %q, want frames=3 and size=150x100", info)
+	}
+	anim, err := gif.DecodeAll(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(anim.Image) != 3 {
+		t.Fatalf("got %d frames, want 3", len(anim.Image))
+	}
+	for i, frame := range anim.Image {
+		if b := frame.Bounds(); b.Dx() != 150 || b.Dy() != 100 {
+			t.Errorf("frame %d: %dx%d, want 150x100", i, b.Dx(), b.Dy())
+		}
+		if anim.Delay[i] != 10*(i+1) {
+			t.Errorf("frame %d: delay %d, want %d", i, anim.Delay[i], 10*(i+1))
+		}
+		r, g, b, _ := frame.At(75, 50).RGBA()
+		want := animColors[i]
+		if absDiff(r>>8, uint32(want.R)) > 10 || absDiff(g>>8, uint32(want.G)) > 10 || absDiff(b>>8, uint32(want.B)) > 10 {
+			t.Errorf("frame %d: color %d,%d,%d, want %v", i, r>>8, g>>8, b>>8, want)
+		}
+	}
+
+	// Animated WebP when accepted
+	rec = resizeGet("/r/w150?"+src, "image/webp,image/*")
+	if ct := rec.Header().Get("Content-Type"); ct != "image/webp" || !strings.Contains(rec.Header().Get("X-Info"), "frames=3") {
+		t.Errorf("webp: content-type %q info %q, want animated image/webp", ct, rec.Header().Get("X-Info"))
+	}
+
+	// anim=0 and still forced formats get the first frame
+	rec = resizeGet("/r/w150&anim=0?"+src, "image/avif,image/*")
+	if ct, info := rec.Header().Get("Content-Type"), rec.Header().Get("X-Info"); ct != "image/avif" ||
+		strings.Contains(info, "frames=") || !strings.Contains(info, "params=w_150_anim0;") {
+		t.Errorf("anim=0: content-type %q info %q, want a still AVIF", ct, info)
+	}
+	rec = resizeGet("/r/w150&anim=0?"+src, "image/webp,image/*")
+	if ct := rec.Header().Get("Content-Type"); ct != "image/webp" || strings.Contains(rec.Header().Get("X-Info"), "frames=") {
+		t.Errorf("anim=0 webp: content-type %q info %q, want a still WebP", ct, rec.Header().Get("X-Info"))
+	}
+	rec = resizeGet("/r/w150&anim=0?"+src, "image/*")
+	if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("anim=0 without AVIF/WebP: content-type %q, want image/png", ct)
+	}
+	rec = resizeGet("/r/w150.png?"+src, "")
+	if w, h := decodedSize(t, rec); w != 150 || h != 100 {
+		t.Errorf("f=png: %dx%d, want 150x100", w, h)
+	}
+
+	if rec := resizeGet("/r/w150&anim=2?"+src, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("anim=2: code=%d, want 400", rec.Code)
+	}
+}
+
+func TestAnimatedGIFMaxSize(t *testing.T) {
+	ts := animServer()
+	defer ts.Close()
+
+	// Frames are capped at MAX_SIZE in the source cache, like stills
+	saved := handlers.MaxSize
+	handlers.MaxSize = 100
+	defer func() { handlers.MaxSize = saved }()
+
+	rec := resizeGet("/r/q80.gif?"+ts.URL+"/big.gif", "")
+	anim, err := gif.DecodeAll(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("decode (info %q): %v", rec.Header().Get("X-Info"), err)
+	}
+	if len(anim.Image) != 3 || anim.Config.Width != 100 || anim.Config.Height != 67 {
+		t.Errorf("got %d frames of %dx%d, want 3 of 100x67", len(anim.Image), anim.Config.Width, anim.Config.Height)
+	}
+}
+
+func TestAnimatedWebPOutput(t *testing.T) {
+	ts := animServer()
+	defer ts.Close()
+	src := ts.URL + "/webp.gif"
+
+	// Frame timing survives the GIF -> WebP conversion
+	rec := resizeGet("/r/w150.webp?"+src, "")
+	if ct := rec.Header().Get("Content-Type"); ct != "image/webp" {
+		t.Fatalf("content-type %q (info %q), want image/webp", ct, rec.Header().Get("X-Info"))
+	}
+	importParams := vips.NewImportParams()
+	importParams.NumPages.Set(-1)
+	img, err := vips.LoadImageFromBuffer(rec.Body.Bytes(), importParams)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	defer img.Close()
+	if img.Width() != 150 || img.PageHeight() != 100 || img.Height() != 300 {
+		t.Errorf("got %dx%d, page height %d, want 3 frames of 150x100", img.Width(), img.Height(), img.PageHeight())
+	}
+	if delay, _ := img.PageDelay(); len(delay) != 3 || delay[0] != 100 || delay[1] != 200 || delay[2] != 300 {
+		t.Errorf("delays %v ms, want [100 200 300]", delay)
+	}
+
+	// Negotiated variants are cached per output format
+	want := "image/webp"
+	if handlers.AnimatedAVIF {
+		want = "image/avif"
+	}
+	for _, c := range []struct {
+		accept, wantType, wantCache string
+	}{
+		{"image/avif,image/webp,image/*", want, "MISS"},
+		{"image/*", "image/gif", "MISS"},
+		{"image/avif,image/webp,image/*", want, "HIT"},
+		{"image/*", "image/gif", "HIT"},
+	} {
+		rec := resizeGet("/r/w120?"+src, c.accept)
+		if ct := rec.Header().Get("Content-Type"); ct != c.wantType || rec.Header().Get("X-Cache") != c.wantCache {
+			t.Errorf("Accept %q: type %q cache %q, want %q %s", c.accept, ct, rec.Header().Get("X-Cache"), c.wantType, c.wantCache)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"image-resize/app/handlers"
+)
+
+// pdfColors are the page fill colors of createTestPDF as PDF rg operands
+var pdfColors = []string{"1 0 0", "0 0 1", "0 1 0"}
+
+// createTestPDF writes a PDF with one 200x100pt page per pdfColors entry,
+// each filled with its color.
+func createTestPDF() []byte {
+	var buf bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	n := len(pdfColors)
+	kids := make([]string, n)
+	for i := range pdfColors {
+		kids[i] = fmt.Sprintf("%d 0 R", 3+2*i)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), n))
+	for i, c := range pdfColors {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 200 100] /Contents %d 0 R >>", 4+2*i))
+		content := c + " rg 0 0 200 100 re f"
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
+
+func documentServer() *httptest.Server {
+	data := createTestPDF()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(data)
+	}))
+}
+
+func TestPDFSource(t *testing.T) {
+	ts := documentServer()
+	defer ts.Close()
+	src := ts.URL + "/doc.pdf"
+
+	centerColor := func(t *testing.T, rec *httptest.ResponseRecorder) (uint32, uint32, uint32) {
+		t.Helper()
+		img, _, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("decode (info %q): %v", rec.Header().Get("X-Info"), err)
+		}
+		b := img.Bounds()
+		r, g, bl, _ := img.At(b.Dx()/2, b.Dy()/2).RGBA()
+		return r >> 8, g >> 8, bl >> 8
+	}
+
+	// Page 1 by default, with the page count in X-Info
+	rec := resizeGet("/r/w100.png?"+src, "")
+	if info := rec.Header().Get("X-Info"); !strings.Contains(info, "input=pdf") || !strings.Contains(info, "pages=3") {
+		t.Errorf("X-Info %q, want input=pdf and pages=3", info)
+	}
+	if w, h := decodedSize(t, rec); w != 100 || h != 50 {
+		t.Errorf("page 1: %dx%d, want 100x50", w, h)
+	}
+	if r, g, b := centerColor(t, rec); r < 200 || g > 50 || b > 50 {
+		t.Errorf("page 1: color %d,%d,%d, want red", r, g, b)
+	}
+
+	// page= picks the page, keyed per page
+	rec = resizeGet("/r/w100&page=2.png?"+src, "")
+	if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params=w_100_page2;") {
+		t.Errorf("page=2: X-Info %q, want params=w_100_page2", info)
+	}
+	if r, g, b := centerColor(t, rec); r > 50 || g > 50 || b < 200 {
+		t.Errorf("page 2: color %d,%d,%d, want blue", r, g, b)
+	}
+
+	// density= sets the render size (200x100pt at 72 and 144 DPI)
+	for _, c := range []struct {
+		density string
+		w, h    int
+	}{
+		{"72", 200, 100},
+		{"144", 400, 200},
+	} {
+		rec := resizeGet("/r/q80&density="+c.density+".png?"+src, "")
+		if w, h := decodedSize(t, rec); w != c.w || h != c.h {
+			t.Errorf("density=%s: %dx%d, want %dx%d", c.density, w, h, c.w, c.h)
+		}
+	}
+
+	// Past the last page
+	rec = resizeGet("/r/w100&page=4?"+src, "")
+	if info := rec.Header().Get("X-Info"); !strings.Contains(info, "page-failed") {
+		t.Errorf("page=4: X-Info %q, want page-failed", info)
+	}
+
+	for _, q := range []string{"page=0", "page=x", "density=10", "density=1000"} {
+		if rec := resizeGet("/r/w100&"+q+"?"+src, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: code=%d, want 400", q, rec.Code)
+		}
+	}
+}
+
+func TestPageOfSingleImage(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+
+	rec := resizeGet("/r/w100&page=2?"+ts.URL+"/test.jpeg?page-single", "")
+	if info := rec.Header().Get("X-Info"); !strings.Contains(info, "page-failed") {
+		t.Errorf("X-Info %q, want page-failed", info)
+	}
+}
+
+func TestDensityOfNonPDF(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+
+	rec := resizeGet("/r/w100&density=300?"+ts.URL+"/test.jpeg?density-single", "")
+	if info := rec.Header().Get("X-Info"); !strings.Contains(info, "density-failed") {
+		t.Errorf("X-Info %q, want density-failed", info)
+	}
+}
+
+func TestDocumentSourceCacheKey(t *testing.T) {
+	for _, c := range []struct {
+		page, density int
+		want          string
+	}{
+		{0, 0, "source"},
+		{2, 0, "source_page2"},
+		{0, 300, "source_density300"},
+		{3, 72, "source_page3_density72"},
+	} {
+		if got := handlers.DocumentSourceCacheKeyForTest(c.page, c.density); got != c.want {
+			t.Errorf("page %d density %d: %q, want %q", c.page, c.density, got, c.want)
+		}
+	}
+}
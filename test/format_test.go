@@ -1,6 +1,10 @@
 package test
 
 import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"image-resize/app/handlers"
@@ -33,3 +37,76 @@ func TestSplitFormatExt(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitB64Source(t *testing.T) {
+	enc := base64.RawURLEncoding.EncodeToString([]byte("https://example.com/a.jpg?x=1"))
+	cases := []struct {
+		path     string
+		wantPath string
+		wantSrc  string
+	}{
+		{"w300/b64/" + enc, "w300", "https://example.com/a.jpg?x=1"},
+		{"s:abc/c40x30/b64/" + enc, "s:abc/c40x30", "https://example.com/a.jpg?x=1"},
+		{"b64/" + enc, "", "https://example.com/a.jpg?x=1"},
+		{"b64/" + enc + "==", "", "https://example.com/a.jpg?x=1"},
+		{"w300", "w300", ""},
+	}
+	for _, c := range cases {
+		gotPath, gotSrc, err := handlers.SplitB64SourceForTest(c.path)
+		if err != nil || gotPath != c.wantPath || gotSrc != c.wantSrc {
+			t.Errorf("splitB64Source(%q) = (%q, %q, %v), want (%q, %q, nil)",
+				c.path, gotPath, gotSrc, err, c.wantPath, c.wantSrc)
+		}
+	}
+	for _, bad := range []string{"w300/b64/", "w300/b64/not*base64"} {
+		if _, _, err := handlers.SplitB64SourceForTest(bad); err == nil {
+			t.Errorf("splitB64Source(%q) should fail", bad)
+		}
+	}
+}
+
+func TestB64SourceURL(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	enc := base64.RawURLEncoding.EncodeToString([]byte(ts.URL + "/test.jpeg"))
+
+	// Query strings appended by intermediaries are ignored
+	rec := resizeGet("/r/w40/b64/"+enc+".png?utm_source=cdn", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("b64 form: code=%d body=%q", rec.Code, rec.Body.String())
+	}
+	if w, h := decodedSize(t, rec); w != 40 || h != 30 {
+		t.Errorf("b64 form: size = %dx%d, want 40x30", w, h)
+	}
+	if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params=w_40;") {
+		t.Errorf("b64 form: X-Info %q, want params=w_40", info)
+	}
+
+	if rec := resizeGet("/r/b64/"+enc+".png", ""); rec.Code != http.StatusOK {
+		t.Errorf("b64 form without params: code=%d", rec.Code)
+	}
+	if rec := resizeGet("/r/w40/b64/not*base64.png", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid b64: code=%d, want 400", rec.Code)
+	}
+}
+
+func TestB64SourceURLNotUnescaped(t *testing.T) {
+	data := createTestJPEG(200, 150)
+	var gotQuery string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	// "+" and "%2F" are part of the source URL, not escapes of the /r/ URL
+	enc := base64.RawURLEncoding.EncodeToString([]byte(ts.URL + "/test.jpeg?a=1+2&p=x%2Fy"))
+	rec := resizeGet("/r/w40/b64/"+enc+".png", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code=%d body=%q", rec.Code, rec.Body.String())
+	}
+	if gotQuery != "a=1+2&p=x%2Fy" {
+		t.Errorf("source fetched with query %q, want %q", gotQuery, "a=1+2&p=x%2Fy")
+	}
+}
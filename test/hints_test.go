@@ -0,0 +1,104 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"image-resize/app/handlers"
+)
+
+func TestClientHints(t *testing.T) {
+	handlers.SetClientHintsForTest(true)
+	defer handlers.SetClientHintsForTest(false)
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg" // 200x150
+
+	get := func(target string, hints map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		for k, v := range hints {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handlers.ResizeHandler(rec, req)
+		return rec
+	}
+
+	cases := []struct {
+		name         string
+		target       string
+		hints        map[string]string
+		wantKey      string
+		wantW, wantH int
+		wantVary     string
+	}{
+		{"width hint bucketed", "/r/w=auto.png?", map[string]string{"Sec-CH-Width": "100"},
+			"w_160", 160, 120, "Sec-CH-Width"},
+		{"viewport times dpr", "/r/wauto.png?", map[string]string{"Sec-CH-Viewport-Width": "90", "Sec-CH-DPR": "2"},
+			"w_160_dpr2", 200, 150, "Sec-CH-Viewport-Width"},
+		{"dpr hint", "/r/w40.png?", map[string]string{"Sec-CH-DPR": "2"},
+			"w_40_dpr2", 80, 60, "Sec-CH-DPR"},
+		{"dpr rounded to half steps", "/r/w40.png?", map[string]string{"Sec-CH-DPR": "1.3"},
+			"w_40_dpr1.5", 60, 45, "Sec-CH-DPR"},
+		{"nan dpr ignored", "/r/w40.png?", map[string]string{"Sec-CH-DPR": "NaN"},
+			"w_40", 40, 30, "Sec-CH-DPR"},
+		{"explicit dpr wins", "/r/w40&dpr=1.png?", map[string]string{"Sec-CH-DPR": "3"},
+			"w_40", 40, 30, "Save-Data"},
+		{"save data", "/r/w40.png?", map[string]string{"Save-Data": "on"},
+			"w_40_q50", 40, 30, "Save-Data"},
+	}
+	// Without w=auto a URL keeps its size, original included
+	for _, target := range []string{"/r.png?", "/r/q80.png?"} {
+		rec := get(target+src, map[string]string{"Sec-CH-Width": "100", "Sec-CH-Viewport-Width": "90"})
+		if w, h := decodedSize(t, rec); w != 200 || h != 150 {
+			t.Errorf("%s: size = %dx%d, want the original 200x150", target, w, h)
+		}
+		if vary := rec.Header().Get("Vary"); strings.Contains(vary, "Width") {
+			t.Errorf("%s: Vary %q should not list width hints", target, vary)
+		}
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rec := get(c.target+src, c.hints)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("code=%d body=%q", rec.Code, rec.Body.String())
+			}
+			if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params="+c.wantKey+";") {
+				t.Errorf("X-Info %q, want params=%s", info, c.wantKey)
+			}
+			if w, h := decodedSize(t, rec); w != c.wantW || h != c.wantH {
+				t.Errorf("size = %dx%d, want %dx%d", w, h, c.wantW, c.wantH)
+			}
+			if vary := rec.Header().Get("Vary"); !strings.Contains(vary, c.wantVary) {
+				t.Errorf("Vary %q should list %s", vary, c.wantVary)
+			}
+			if rec.Header().Get("Accept-CH") == "" {
+				t.Error("Accept-CH should be advertised")
+			}
+		})
+	}
+
+	// Signatures cover the URL as minted, hints still apply on top
+	handlers.SetSigningForTest("test-secret", handlers.SigningEnforce)
+	signed, err := handlers.SignURL("w40.png", src)
+	if err != nil {
+		t.Fatalf("SignURL: %v", err)
+	}
+	rec := get(signed, map[string]string{"Sec-CH-DPR": "2"})
+	handlers.SetSigningForTest("", handlers.SigningOff)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("signed + hints: code=%d body=%q", rec.Code, rec.Body.String())
+	}
+	if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params=w_40_dpr2;") {
+		t.Errorf("signed + hints: X-Info %q, want params=w_40_dpr2", info)
+	}
+
+	handlers.SetClientHintsForTest(false)
+	rec = get("/r/w40.png?"+src, map[string]string{"Sec-CH-DPR": "2"})
+	if rec.Header().Get("Accept-CH") != "" || !strings.Contains(rec.Header().Get("X-Info"), "params=w_40;") {
+		t.Errorf("hints disabled: Accept-CH %q, X-Info %q", rec.Header().Get("Accept-CH"), rec.Header().Get("X-Info"))
+	}
+}
@@ -0,0 +1,787 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"image-resize/app/handlers"
+)
+
+// resizeGet runs target through ResizeHandler with the given Accept header.
+func resizeGet(target, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	handlers.ResizeHandler(rec, req)
+	return rec
+}
+
+// decodedSize decodes a PNG/JPEG response body and returns its dimensions.
+func decodedSize(t *testing.T, rec *httptest.ResponseRecorder) (int, int) {
+	t.Helper()
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("decode response (type %q, info %q): %v",
+			rec.Header().Get("Content-Type"), rec.Header().Get("X-Info"), err)
+	}
+	return cfg.Width, cfg.Height
+}
+
+// ---------------------------------------------------------------------------
+// dpr: device pixel ratio multiplier
+// ---------------------------------------------------------------------------
+
+func TestDPRParam(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg" // 200x150
+
+	cases := []struct {
+		name          string
+		target        string
+		wantW, wantH  int
+		wantKeyPrefix string
+	}{
+		{"query dpr", "/r/w40&dpr=2.png?" + src, 80, 60, "w_40_dpr2"},
+		{"path shorthand", "/r/w40&dpr2.png?" + src, 80, 60, "w_40_dpr2"},
+		{"crop", "/r/c40x30&dpr=1.5.png?" + src, 60, 45, "c_40x30_dpr1.5"},
+		{"dpr1 is a no-op", "/r/w40&dpr1.png?" + src, 40, 30, "w_40"},
+		// no-upscale rule still applies to the multiplied size
+		{"no upscale", "/r/w150&dpr=2.png?" + src, 200, 150, "w_150_dpr2"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rec := resizeGet(c.target, "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("code=%d body=%q", rec.Code, rec.Body.String())
+			}
+			if w, h := decodedSize(t, rec); w != c.wantW || h != c.wantH {
+				t.Errorf("size = %dx%d, want %dx%d", w, h, c.wantW, c.wantH)
+			}
+			info := rec.Header().Get("X-Info")
+			if !strings.Contains(info, "params="+c.wantKeyPrefix+";") {
+				t.Errorf("X-Info %q should carry params=%s", info, c.wantKeyPrefix)
+			}
+		})
+	}
+
+	for _, bad := range []string{"dpr=0.5", "dpr=5", "dpr=abc", "dpr=NaN"} {
+		if rec := resizeGet("/r/w40&"+bad+"?"+src, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: code=%d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// g= / fp=: crop anchoring
+// ---------------------------------------------------------------------------
+
+func TestCropOffset(t *testing.T) {
+	// 300x100 image cropped to 100x100: 200px of horizontal slack
+	cases := []struct {
+		name         string
+		gravity      string
+		fx, fy       float64
+		hasFocal     bool
+		wantX, wantY int
+	}{
+		{"default centered", "", 0, 0, false, 100, 0},
+		{"west", "west", 0, 0, false, 0, 0},
+		{"east", "east", 0, 0, false, 200, 0},
+		{"se", "se", 0, 0, false, 200, 0},
+		{"focal left third", "", 0.33, 0.5, true, 49, 0},
+		{"focal clamped at edge", "", 0.99, 0.5, true, 200, 0},
+	}
+	for _, c := range cases {
+		x, y := handlers.CropOffsetForTest(300, 100, 100, 100, c.gravity, c.fx, c.fy, c.hasFocal)
+		if x != c.wantX || y != c.wantY {
+			t.Errorf("%s: offset = (%d, %d), want (%d, %d)", c.name, x, y, c.wantX, c.wantY)
+		}
+	}
+
+	// Portrait slack: default anchor sits 30% from the top, south at the bottom
+	if _, y := handlers.CropOffsetForTest(100, 300, 100, 100, "", 0, 0, false); y != 60 {
+		t.Errorf("default vertical offset = %d, want 60", y)
+	}
+	if _, y := handlers.CropOffsetForTest(100, 300, 100, 100, "south", 0, 0, false); y != 200 {
+		t.Errorf("south vertical offset = %d, want 200", y)
+	}
+}
+
+func TestCropGravityParams(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg"
+
+	cases := []struct {
+		target  string
+		wantKey string
+	}{
+		{"/r/c40&g=north.png?", "c_40x40_g-north"},
+		{"/r/c40&g=NorthEast.png?", "c_40x40_g-ne"},
+		{"/r/c40&fp=0.42,0.61.png?", "c_40x40_fp0.42x0.61"},
+		// anchors don't affect fit mode, so they don't split its cache
+		{"/r/w40&g=north.png?", "w_40"},
+	}
+	for _, c := range cases {
+		rec := resizeGet(c.target+src, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: code=%d body=%q", c.target, rec.Code, rec.Body.String())
+		}
+		if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params="+c.wantKey+";") {
+			t.Errorf("%s: X-Info %q, want params=%s", c.target, info, c.wantKey)
+		}
+	}
+
+	for _, bad := range []string{"g=up", "fp=1.5,0", "fp=0.5", "fp=NaN,NaN", "g=north&fp=0.5,0.5"} {
+		if rec := resizeGet("/r/c40&"+bad+"?"+src, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: code=%d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+func TestSmartCrop(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg"
+
+	cases := []struct {
+		target       string
+		wantKey      string
+		wantW, wantH int
+	}{
+		{"/r/c40&crop=smart.png?", "c_40x40_g-attention", 40, 40},
+		{"/r/c40x30&g=attention.png?", "c_40x30_g-attention", 40, 30},
+		{"/r/c40x30&g=entropy.png?", "c_40x30_g-entropy", 40, 30},
+	}
+	for _, c := range cases {
+		rec := resizeGet(c.target+src, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: code=%d body=%q", c.target, rec.Code, rec.Body.String())
+		}
+		if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params="+c.wantKey+";") {
+			t.Errorf("%s: X-Info %q, want params=%s", c.target, info, c.wantKey)
+		}
+		if w, h := decodedSize(t, rec); w != c.wantW || h != c.wantH {
+			t.Errorf("%s: size = %dx%d, want %dx%d", c.target, w, h, c.wantW, c.wantH)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// fit=: explicit fit modes and pad background
+// ---------------------------------------------------------------------------
+
+func TestFitModes(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg" // 200x150
+
+	cases := []struct {
+		target       string
+		wantKey      string
+		wantW, wantH int
+	}{
+		{"/r/w40x40&fit=inside.png?", "w_40x40", 40, 30},
+		{"/r/w40x40&fit=cover.png?", "c_40x40", 40, 40},
+		{"/r/w40x40&fit=pad.png?", "w_40x40_pad-transparent", 40, 40},
+		{"/r/w40x40&fit=contain&bg=F00.png?", "w_40x40_pad-ff0000", 40, 40},
+		{"/r/w40x40&fit=pad&g=north.png?", "w_40x40_pad-transparent_g-north", 40, 40},
+		{"/r/w40x40&fit=fill.png?", "w_40x40_fill", 40, 40},
+		// fill doesn't stretch an axis past the original without up=1
+		{"/r/w100x300&fit=fill.png?", "w_100x300_fill", 100, 150},
+		{"/r/w40x40&fit=outside.png?", "w_40x40_outside", 53, 40},
+		// pad never enlarges the image but still emits the full canvas
+		{"/r/w400x300&fit=pad.png?", "w_400x300_pad-transparent", 400, 300},
+	}
+	for _, c := range cases {
+		rec := resizeGet(c.target+src, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: code=%d body=%q", c.target, rec.Code, rec.Body.String())
+		}
+		if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params="+c.wantKey+";") {
+			t.Errorf("%s: X-Info %q, want params=%s", c.target, info, c.wantKey)
+		}
+		if w, h := decodedSize(t, rec); w != c.wantW || h != c.wantH {
+			t.Errorf("%s: size = %dx%d, want %dx%d", c.target, w, h, c.wantW, c.wantH)
+		}
+	}
+
+	// 40x30 image centered on a 40x40 red canvas: the top row is padding
+	rec := resizeGet("/r/w40x40&fit=pad&bg=ff0000.png?"+src, "")
+	img, _, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("decode pad response: %v", err)
+	}
+	if r, g, b, _ := img.At(20, 0).RGBA(); r>>8 != 255 || g>>8 != 0 || b>>8 != 0 {
+		t.Errorf("pad pixel = (%d, %d, %d), want red", r>>8, g>>8, b>>8)
+	}
+
+	for _, bad := range []string{"w40&fit=pad", "c40&fit=pad", "w40x40&fit=stretch",
+		"w40x40&fit=pad&g=attention", "w40x40&fit=pad&bg=nope"} {
+		if rec := resizeGet("/r/"+bad+"?"+src, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: code=%d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// up=1: opt-in enlargement
+// ---------------------------------------------------------------------------
+
+func TestUpscale(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg" // 200x150
+
+	handlers.SetUpscaleForTest(true, 2)
+	defer handlers.SetUpscaleForTest(false, 2)
+
+	cases := []struct {
+		target       string
+		wantKey      string
+		wantW, wantH int
+		wantUpscale  string // "" = not reported
+	}{
+		{"/r/w300&up=1.png?", "w_300_up", 300, 225, "enlarged"},
+		{"/r/c300x300&up=1.png?", "c_300x300_up", 300, 300, "enlarged"},
+		// 4x needed, capped at 2x: 400x300 cover, crop window shrunk to stay square
+		{"/r/c600x600&up=1.png?", "c_600x600_up", 300, 300, "clamped"},
+		{"/r/w300x300&fit=pad&up=1.png?", "w_300x300_pad-transparent_up", 300, 300, "enlarged"},
+		{"/r/w300.png?", "w_300", 200, 150, "unchanged"},
+		{"/r/w100&up=1.png?", "w_100_up", 100, 75, ""},
+	}
+	for _, c := range cases {
+		rec := resizeGet(c.target+src, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: code=%d body=%q", c.target, rec.Code, rec.Body.String())
+		}
+		info := rec.Header().Get("X-Info")
+		if !strings.Contains(info, "params="+c.wantKey+";") {
+			t.Errorf("%s: X-Info %q, want params=%s", c.target, info, c.wantKey)
+		}
+		if c.wantUpscale == "" && strings.Contains(info, "upscale=") {
+			t.Errorf("%s: X-Info %q should not report upscale", c.target, info)
+		} else if c.wantUpscale != "" && !strings.Contains(info, "upscale="+c.wantUpscale) {
+			t.Errorf("%s: X-Info %q, want upscale=%s", c.target, info, c.wantUpscale)
+		}
+		if w, h := decodedSize(t, rec); w != c.wantW || h != c.wantH {
+			t.Errorf("%s: size = %dx%d, want %dx%d", c.target, w, h, c.wantW, c.wantH)
+		}
+	}
+
+	if rec := resizeGet("/r/w300&up=2?"+src, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("up=2: code=%d, want 400", rec.Code)
+	}
+
+	// The enlarged output, not just the requested size, stays within MAX_SIZE:
+	// h300 wants 400x300, capped to 300x225
+	saved := handlers.MaxSize
+	handlers.MaxSize = 300
+	rec := resizeGet("/r/h300&up=1.png?"+src+"?up-maxsize", "")
+	handlers.MaxSize = saved
+	if w, h := decodedSize(t, rec); w != 300 || h != 225 || !strings.Contains(rec.Header().Get("X-Info"), "upscale=clamped") {
+		t.Errorf("h300 with MAX_SIZE=300: %dx%d info %q, want 300x225 clamped", w, h, rec.Header().Get("X-Info"))
+	}
+
+	// Server policy off: up=1 is ignored and stays out of the cache key
+	handlers.SetUpscaleForTest(false, 2)
+	rec = resizeGet("/r/w320&up=1.png?"+src, "")
+	if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params=w_320;") || !strings.Contains(info, "upscale=unchanged") {
+		t.Errorf("disallowed up=1: X-Info %q, want params=w_320 and upscale=unchanged", info)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// q=: per-request quality
+// ---------------------------------------------------------------------------
+
+func TestQualityParam(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg"
+
+	handlers.SetQualityBoundsForTest(50, 90)
+	defer handlers.SetQualityBoundsForTest(40, 100)
+
+	cases := []struct {
+		target  string
+		wantKey string
+	}{
+		{"/r/w100&q=60.jpg?", "w_100_q60"},
+		{"/r/w100&q60.jpg?", "w_100_q60"},
+		// clamped to the admin bounds
+		{"/r/w100&q40.jpg?", "w_100_q50"},
+		{"/r/w100&q100.jpg?", "w_100_q90"},
+		// quality alone is a cacheable variant
+		{"/r/q70.jpg?", "q70"},
+	}
+	sizes := map[string]int{}
+	for _, c := range cases {
+		rec := resizeGet(c.target+src, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: code=%d body=%q", c.target, rec.Code, rec.Body.String())
+		}
+		if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params="+c.wantKey+";") {
+			t.Errorf("%s: X-Info %q, want params=%s", c.target, info, c.wantKey)
+		}
+		sizes[c.wantKey] = rec.Body.Len()
+	}
+	if sizes["w_100_q50"] >= sizes["w_100_q90"] {
+		t.Errorf("q50 output (%d bytes) should be smaller than q90 (%d bytes)", sizes["w_100_q50"], sizes["w_100_q90"])
+	}
+
+	for _, bad := range []string{"q=30", "q=101", "q=high"} {
+		if rec := resizeGet("/r/w100&"+bad+"?"+src, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: code=%d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// rot= / flip= and EXIF auto-orientation
+// ---------------------------------------------------------------------------
+
+func TestOrientation(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg" // 200x150, red increases left to right
+
+	cases := []struct {
+		target       string
+		wantKey      string
+		wantW, wantH int
+	}{
+		// w= applies to the rotated image
+		{"/r/w100&rot=90.png?", "w_100_rot90", 100, 133},
+		{"/r/w100&rot=-90.png?", "w_100_rot270", 100, 133},
+		{"/r/w100&rot=180.png?", "w_100_rot180", 100, 75},
+		{"/r/w100&rot=360.png?", "w_100", 100, 75},
+		// flip=hv is a 180° turn and shares its cache entry
+		{"/r/w100&flip=hv.png?", "w_100_rot180", 100, 75},
+		{"/r/w100&rot=90&flip=v.png?", "w_100_rot90_flip-v", 100, 133},
+		{"/r/c80x40&flip=h.png?", "c_80x40_flip-h", 80, 40},
+	}
+	for _, c := range cases {
+		rec := resizeGet(c.target+src, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: code=%d body=%q", c.target, rec.Code, rec.Body.String())
+		}
+		if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params="+c.wantKey+";") {
+			t.Errorf("%s: X-Info %q, want params=%s", c.target, info, c.wantKey)
+		}
+		if w, h := decodedSize(t, rec); w != c.wantW || h != c.wantH {
+			t.Errorf("%s: size = %dx%d, want %dx%d", c.target, w, h, c.wantW, c.wantH)
+		}
+	}
+
+	// flip=h mirrors the red gradient: the left edge turns red
+	rec := resizeGet("/r/w100&flip=h.png?"+src, "")
+	img, _, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("decode flip response: %v", err)
+	}
+	if r, _, _, _ := img.At(1, 37).RGBA(); r>>8 < 200 {
+		t.Errorf("flip=h left edge red = %d, want > 200", r>>8)
+	}
+
+	for _, bad := range []string{"rot=45", "rot=left", "flip=x"} {
+		if rec := resizeGet("/r/w100&"+bad+"?"+src, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: code=%d, want 400", bad, rec.Code)
+		}
+	}
+
+	// EXIF Orientation=6 is applied at ingest: the 200x150 source is portrait
+	rec = resizeGet("/r/w75.png?"+ts.URL+"/exif6.jpeg", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("exif6: code=%d body=%q", rec.Code, rec.Body.String())
+	}
+	if w, h := decodedSize(t, rec); w != 75 || h != 100 {
+		t.Errorf("exif6: size = %dx%d, want 75x100", w, h)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Color operations: bri, con, sat, gray, sepia, tint
+// ---------------------------------------------------------------------------
+
+func TestColorOps(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg"
+
+	// Center pixel of the test gradient is roughly (127, 127, 128)
+	cases := []struct {
+		target  string
+		wantKey string
+		check   func(r, g, b uint32) bool
+	}{
+		{"/r/w100&gray=1.png?", "w_100_gray", func(r, g, b uint32) bool { return r == g && g == b }},
+		{"/r/w100&sat=-100.png?", "w_100_sat-100", func(r, g, b uint32) bool { return absDiff(r, g) <= 3 && absDiff(g, b) <= 3 }},
+		{"/r/w100&bri=-100.png?", "w_100_bri-100", func(r, g, b uint32) bool { return r < 5 && g < 5 && b < 5 }},
+		{"/r/w100&con=-100.png?", "w_100_con-100", func(r, g, b uint32) bool { return absDiff(r, 119) <= 12 && absDiff(b, 119) <= 12 }},
+		{"/r/w100&sepia=1.png?", "w_100_sepia", func(r, g, b uint32) bool { return r > g && g > b }},
+		{"/r/w100&tint=F00.png?", "w_100_tint-ff0000", func(r, g, b uint32) bool { return r > 80 && g < 5 && b < 5 }},
+		{"/r/w100&bri=10&sat=20&tint=0066cc.png?", "w_100_bri10_sat20_tint-0066cc", func(r, g, b uint32) bool { return r < 5 && b > g }},
+	}
+	for _, c := range cases {
+		rec := resizeGet(c.target+src, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: code=%d body=%q", c.target, rec.Code, rec.Body.String())
+		}
+		if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params="+c.wantKey+";") {
+			t.Errorf("%s: X-Info %q, want params=%s", c.target, info, c.wantKey)
+		}
+		img, _, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: decode: %v", c.target, err)
+		}
+		r, g, b, _ := img.At(50, 37).RGBA()
+		if !c.check(r>>8, g>>8, b>>8) {
+			t.Errorf("%s: center pixel = (%d, %d, %d)", c.target, r>>8, g>>8, b>>8)
+		}
+	}
+
+	for _, bad := range []string{"bri=101", "con=x", "sat=-200", "gray=2", "tint=blue", "gray=1&sepia=1", "sepia=1&tint=f00"} {
+		if rec := resizeGet("/r/w100&"+bad+"?"+src, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: code=%d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+func absDiff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// ---------------------------------------------------------------------------
+// blur= / sharpen=
+// ---------------------------------------------------------------------------
+
+func TestFilters(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg"
+
+	cases := []struct {
+		target  string
+		wantKey string
+	}{
+		{"/r/w100&blur=20.png?", "w_100_blur20"},
+		{"/r/w100&blur=2.54.png?", "w_100_blur2.5"},
+		{"/r/w100&blur=2&sharpen=1.5.png?", "w_100_blur2_sharpen1.5"},
+		{"/r/w100&sharpen=1.5.png?", "w_100_sharpen1.5"},
+		{"/r/w100&sharpen=2&gray=1.png?", "w_100_sharpen2_gray"},
+	}
+	for _, c := range cases {
+		rec := resizeGet(c.target+src, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: code=%d body=%q", c.target, rec.Code, rec.Body.String())
+		}
+		if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params="+c.wantKey+";") {
+			t.Errorf("%s: X-Info %q, want params=%s", c.target, info, c.wantKey)
+		}
+	}
+
+	// 40x30 image centered on a red 40x40 canvas: row 4 is the last padding
+	// row, blur pulls the image's blue into it
+	pixelAt := func(target string, x, y int) (uint32, uint32, uint32) {
+		rec := resizeGet(target+src, "")
+		img, _, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: decode: %v", target, err)
+		}
+		r, g, b, _ := img.At(x, y).RGBA()
+		return r >> 8, g >> 8, b >> 8
+	}
+	if _, _, b := pixelAt("/r/w40x40&fit=pad&bg=ff0000.png?", 20, 4); b > 5 {
+		t.Errorf("unblurred padding blue = %d, want 0", b)
+	}
+	if _, _, b := pixelAt("/r/w40x40&fit=pad&bg=ff0000&blur=3.png?", 20, 4); b < 20 {
+		t.Errorf("blurred padding blue = %d, want > 20", b)
+	}
+
+	plain := resizeGet("/r/w100.png?"+src, "").Body.Bytes()
+	sharp := resizeGet("/r/w100&sharpen=5.png?"+src, "").Body.Bytes()
+	if bytes.Equal(plain, sharp) {
+		t.Error("sharpen=5 output is identical to the unsharpened image")
+	}
+
+	for _, bad := range []string{"blur=0.1", "blur=100", "sharpen=11", "sharpen=x", "blur=NaN"} {
+		if rec := resizeGet("/r/w100&"+bad+"?"+src, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: code=%d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// txt= text overlays
+// ---------------------------------------------------------------------------
+
+func TestTextOverlay(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg" // 200x150, blue is 128 everywhere
+
+	sum := sha256.Sum256([]byte("SOLD OUT"))
+	hash := hex.EncodeToString(sum[:16])
+
+	// Pure green glyph pixels are the only ones with low blue
+	greenRows := func(target string) (count, minY, maxY int) {
+		t.Helper()
+		rec := resizeGet(target+src, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: code=%d body=%q", target, rec.Code, rec.Body.String())
+		}
+		img, _, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: decode: %v", target, err)
+		}
+		minY, maxY = img.Bounds().Dy(), -1
+		for y := 0; y < img.Bounds().Dy(); y++ {
+			for x := 0; x < img.Bounds().Dx(); x++ {
+				r, g, b, _ := img.At(x, y).RGBA()
+				if g>>8 > 200 && r>>8 < 60 && b>>8 < 60 {
+					count++
+					minY, maxY = min(minY, y), max(maxY, y)
+				}
+			}
+		}
+		return count, minY, maxY
+	}
+
+	rec := resizeGet("/r/w200&txt=SOLD%20OUT&txtsize=24&txtcolor=0f0&txtg=north.png?"+src, "")
+	wantKey := "w_200_txt-" + hash + "_txtsize24_txtcolor-00ff00_txtg-north"
+	if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params="+wantKey+";") {
+		t.Errorf("X-Info %q, want params=%s", info, wantKey)
+	}
+
+	// Zero-padded sizes share the variant
+	rec = resizeGet("/r/w200&txt=SOLD%20OUT&txtsize=024&txtcolor=0f0&txtg=north.png?"+src, "")
+	if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params="+wantKey+";") {
+		t.Errorf("txtsize=024: X-Info %q, want params=%s", info, wantKey)
+	}
+
+	if n, _, maxY := greenRows("/r/w200&txt=SOLD%20OUT&txtsize=24&txtcolor=0f0&txtg=north.png?"); n < 50 || maxY >= 75 {
+		t.Errorf("txtg=north: %d text pixels down to row %d, want text in the top half", n, maxY)
+	}
+	if n, minY, _ := greenRows("/r/w200&txt=SOLD%20OUT&txtsize=24&txtcolor=0f0&txtg=south.png?"); n < 50 || minY < 75 {
+		t.Errorf("txtg=south: %d text pixels from row %d, want text in the bottom half", n, minY)
+	}
+
+	// Pango markup characters render literally
+	if rec := resizeGet("/r/w200&txt=%3Cb%3E%3C%2Fb%3E%20%22$9.99%22.png?"+src, ""); rec.Code != http.StatusOK ||
+		rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("markup text: code=%d type=%q info=%q", rec.Code, rec.Header().Get("Content-Type"), rec.Header().Get("X-Info"))
+	}
+
+	for _, bad := range []string{"txtsize=20", "txt=a&txtsize=2", "txt=a&txtg=attention", "txt=a&txtcolor=nope",
+		"txt=" + strings.Repeat("x", 201)} {
+		if rec := resizeGet("/r/w100&"+bad+"?"+src, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%.40s: code=%d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// rect= / rectp= source regions
+// ---------------------------------------------------------------------------
+
+func TestRect(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg" // 200x150, red grows left to right
+
+	cases := []struct {
+		target  string
+		wantKey string
+		w, h    int
+	}{
+		{"/r/rect=0,0,100,50.png?", "rect0x0x100x50", 100, 50},
+		{"/r/rectp=50,0,50,100.png?", "rectp50x0x50x100", 100, 150},
+		{"/r/w50&rectp=0,0,25.004,40.png?", "w_50_rectp0x0x25x40", 50, 60},
+		// Clipped at the right edge
+		{"/r/rect=150,0,100,150.png?", "rect150x0x100x150", 50, 150},
+	}
+	for _, c := range cases {
+		rec := resizeGet(c.target+src, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: code=%d body=%q", c.target, rec.Code, rec.Body.String())
+		}
+		if info := rec.Header().Get("X-Info"); !strings.Contains(info, c.wantKey) {
+			t.Errorf("%s: X-Info %q, want %s", c.target, info, c.wantKey)
+		}
+		if w, h := decodedSize(t, rec); w != c.w || h != c.h {
+			t.Errorf("%s: got %dx%d, want %dx%d", c.target, w, h, c.w, c.h)
+		}
+	}
+
+	leftRed := func(target, src string) uint32 {
+		t.Helper()
+		rec := resizeGet(target+src, "")
+		img, _, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: decode (info %q): %v", target, rec.Header().Get("X-Info"), err)
+		}
+		r, _, _, _ := img.At(0, img.Bounds().Dy()/2).RGBA()
+		return r >> 8
+	}
+	if r := leftRed("/r/rect=100,0,100,150.png?", src); r < 115 || r > 140 {
+		t.Errorf("right half: left edge red = %d, want ~127", r)
+	}
+
+	// Sources are cached downscaled to MAX_SIZE: pixel rects still refer to
+	// the original image
+	saved := handlers.MaxSize
+	handlers.MaxSize = 100
+	defer func() { handlers.MaxSize = saved }()
+	small := ts.URL + "/test.jpeg?rect-maxsize"
+	if r := leftRed("/r/rect=100,0,100,150.png?", small); r < 115 || r > 140 {
+		t.Errorf("downscaled source: left edge red = %d, want ~127", r)
+	}
+	handlers.MaxSize = saved
+
+	// Starts past the right edge: valid params, fails on the image
+	if rec := resizeGet("/r/w100&rect=300,0,10,10.png?"+src, ""); !strings.Contains(rec.Header().Get("X-Info"), "rect-failed") {
+		t.Errorf("rect outside the image: code=%d info=%q, want rect-failed", rec.Code, rec.Header().Get("X-Info"))
+	}
+
+	for _, bad := range []string{"rect=1,2,3", "rect=0,0,0,10", "rect=-1,0,10,10", "rect=0.5,0,10,10",
+		"rectp=60,0,50,50", "rect=0,0,10,10&rectp=0,0,10,10", "rect=a,b,c,d", "rectp=NaN,0,10,10"} {
+		if rec := resizeGet("/r/w100&"+bad+"?"+src, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: code=%d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// trim= uniform border removal
+// ---------------------------------------------------------------------------
+
+func TestTrim(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+
+	cases := []struct {
+		target  string
+		path    string
+		wantKey string
+		w, h    int
+	}{
+		// White border, color from the top-left pixel
+		{"/r/trim=1.png?", "/bordered.jpeg", "trim10", 96, 64},
+		{"/r/trim=25&trimcolor=fff.png?", "/bordered.jpeg", "trim25-ffffff", 96, 64},
+		// Transparent border
+		{"/r/trim=1.png?", "/padded.png", "trim10", 96, 64},
+		// Trimmed before sizing: w= applies to the block
+		{"/r/w48&trim=1.png?", "/bordered.jpeg", "w_48_trim10", 48, 32},
+		// Nothing in the given color to trim
+		{"/r/trim=1&trimcolor=000.png?", "/bordered.jpeg", "trim10-000000", 200, 150},
+	}
+	for _, c := range cases {
+		rec := resizeGet(c.target+ts.URL+c.path, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s%s: code=%d body=%q", c.target, c.path, rec.Code, rec.Body.String())
+		}
+		if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params="+c.wantKey+";") {
+			t.Errorf("%s%s: X-Info %q, want params=%s", c.target, c.path, info, c.wantKey)
+		}
+		if w, h := decodedSize(t, rec); w != c.w || h != c.h {
+			t.Errorf("%s%s: got %dx%d, want %dx%d", c.target, c.path, w, h, c.w, c.h)
+		}
+	}
+
+	src := ts.URL + "/bordered.jpeg"
+	for _, bad := range []string{"trim=1000", "trim=x", "trimcolor=fff", "trim=1&trimcolor=nope"} {
+		if rec := resizeGet("/r/w100&"+bad+"?"+src, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: code=%d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// JPEG/PNG encoder settings
+// ---------------------------------------------------------------------------
+
+// jpegSOF returns the start-of-frame marker of a JPEG: 0xC0 baseline, 0xC2
+// progressive, 0 if none found.
+func jpegSOF(data []byte) byte {
+	for i := 2; i+3 < len(data); {
+		if data[i] != 0xFF {
+			return 0
+		}
+		marker := data[i+1]
+		if marker == 0xC0 || marker == 0xC1 || marker == 0xC2 {
+			return marker
+		}
+		i += 2 + int(data[i+2])<<8 + int(data[i+3])
+	}
+	return 0
+}
+
+func TestEncodeOptions(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg"
+
+	// Progressive by default (JPEG_INTERLACE), baseline with interlace=0
+	if sof := jpegSOF(resizeGet("/r/w100.jpg?"+src, "").Body.Bytes()); sof != 0xC2 {
+		t.Errorf("default: SOF %#x, want progressive 0xc2", sof)
+	}
+	rec := resizeGet("/r/w100&interlace=0.jpg?"+src, "")
+	if sof := jpegSOF(rec.Body.Bytes()); sof != 0xC0 {
+		t.Errorf("interlace=0: SOF %#x, want baseline 0xc0", sof)
+	}
+	if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params=w_100_interlace0;") {
+		t.Errorf("interlace=0: X-Info %q, want params=w_100_interlace0", info)
+	}
+
+	// Legacy browsers (no AVIF/WebP) get the JPEG fallback with the options
+	rec = resizeGet("/r/w100&optimize=1&trellis=1?"+src, "image/*")
+	if ct, info := rec.Header().Get("Content-Type"), rec.Header().Get("X-Info"); ct != "image/jpeg" ||
+		!strings.Contains(info, "params=w_100_optimize1_trellis1;") {
+		t.Errorf("optimize+trellis: type %q info %q", ct, info)
+	}
+
+	for _, c := range []struct {
+		subsample string
+		want      image.YCbCrSubsampleRatio
+	}{
+		{"420", image.YCbCrSubsampleRatio420},
+		{"444", image.YCbCrSubsampleRatio444},
+	} {
+		rec := resizeGet("/r/w100&subsample="+c.subsample+".jpg?"+src, "")
+		img, _, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("subsample=%s: decode: %v", c.subsample, err)
+		}
+		if ycc, ok := img.(*image.YCbCr); !ok || ycc.SubsampleRatio != c.want {
+			t.Errorf("subsample=%s: got %T, want ratio %v", c.subsample, img, c.want)
+		}
+	}
+
+	// PNG zlib level
+	stored := resizeGet("/r/w200&pngcomp=0.png?"+src, "").Body.Len()
+	packed := resizeGet("/r/w200&pngcomp=9&pngfilter=all.png?"+src, "").Body.Len()
+	if packed >= stored {
+		t.Errorf("pngcomp=9 %d bytes, pngcomp=0 %d bytes, want smaller", packed, stored)
+	}
+
+	for _, bad := range []string{"interlace=2", "optimize=yes", "subsample=411", "pngcomp=10", "pngfilter=median"} {
+		if rec := resizeGet("/r/w100&"+bad+"?"+src, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: code=%d, want 400", bad, rec.Code)
+		}
+	}
+}
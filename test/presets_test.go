@@ -0,0 +1,78 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"image-resize/app/handlers"
+)
+
+func TestPresets(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+
+	err := handlers.LoadPresetsForTest(map[string]string{
+		"card":     "c50x40",
+		"hero":     "w64.png",
+		"Bad Name": "w10",
+		"broken":   "c1x2x3",
+	}, false)
+	defer handlers.LoadPresetsForTest(nil, false)
+	if err == nil {
+		t.Error("invalid presets should be reported")
+	}
+	if list := handlers.ListPresets(); len(list) != 2 || list[0].Name != "card" || list[1].Name != "hero" {
+		t.Fatalf("ListPresets = %+v, want card and hero", list)
+	}
+
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Accept", "image/webp,*/*")
+		rec := httptest.NewRecorder()
+		handlers.ResizeHandler(rec, req)
+		return rec
+	}
+
+	src := ts.URL + "/test.jpeg"
+
+	rec := get("/r/p=card?" + src)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("p=card: code=%d body=%q", rec.Code, rec.Body.String())
+	}
+	if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params=c_50x40") {
+		t.Errorf("p=card X-Info = %q, want resolved c_50x40 params", info)
+	}
+
+	// Raw equivalent shares the cache entry
+	time.Sleep(200 * time.Millisecond)
+	if rec := get("/r/c50x40?" + src); rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("c50x40 after p=card: X-Cache=%q, want HIT", rec.Header().Get("X-Cache"))
+	}
+
+	// Preset format, overridden by the request extension
+	if rec := get("/r/p=hero?" + src); rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("p=hero: type=%q, want image/png", rec.Header().Get("Content-Type"))
+	}
+	if rec := get("/r/p=hero.webp?" + src); rec.Header().Get("Content-Type") != "image/webp" {
+		t.Errorf("p=hero.webp: type=%q, want image/webp", rec.Header().Get("Content-Type"))
+	}
+
+	if rec := get("/r/p=nope?" + src); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown preset: code=%d, want 400", rec.Code)
+	}
+
+	// Presets-only mode rejects raw sizes but still serves presets
+	handlers.LoadPresetsForTest(map[string]string{"card": "c50x40"}, true)
+	if rec := get("/r/w50?" + src); rec.Code != http.StatusBadRequest {
+		t.Errorf("presets only, raw w50: code=%d, want 400", rec.Code)
+	}
+	if rec := get("/r/p=card&w=500?" + src); rec.Code != http.StatusBadRequest {
+		t.Errorf("presets only, override: code=%d, want 400", rec.Code)
+	}
+	if rec := get("/r/p=card.png?" + src); rec.Code != http.StatusOK {
+		t.Errorf("presets only, p=card.png: code=%d", rec.Code)
+	}
+}
@@ -37,6 +37,11 @@ func imageServer() *httptest.Server {
 		"/test.gif":  {createTestGIF(200, 150), "image/gif"},
 		"/test.webp": {createTestWebP(200, 150), "image/webp"},
 		"/test.avif": {createTestAVIF(200, 150), "image/avif"},
+		// Stored landscape, EXIF says rotate 90° CW for display (phone photo)
+		"/exif6.jpeg": {withEXIFOrientation(createTestJPEG(200, 150), 6), "image/jpeg"},
+		// 96x64 block on a white / transparent margin (supplier product shots)
+		"/bordered.jpeg": {createBorderedJPEG(200, 150), "image/jpeg"},
+		"/padded.png":    {createPaddedPNG(200, 150), "image/png"},
 		"/test.svg": {[]byte(`<svg xmlns="http://www.w3.org/2000/svg" width="200" height="150">
 			<rect width="200" height="150" fill="red"/>
 		</svg>`), "image/svg+xml"},
@@ -1118,6 +1123,22 @@ func createTestJPEG(width, height int) []byte {
 	return buf.Bytes()
 }
 
+// withEXIFOrientation inserts a minimal APP1 Exif segment carrying only the
+// Orientation tag right after the JPEG SOI marker.
+func withEXIFOrientation(jpegData []byte, orientation byte) []byte {
+	app1 := []byte{
+		0xFF, 0xE1, 0x00, 0x22, // APP1, length 34
+		'E', 'x', 'i', 'f', 0, 0,
+		'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08, // big-endian TIFF header
+		0x00, 0x01, // one IFD entry
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, orientation, 0x00, 0x00, // Orientation SHORT
+		0x00, 0x00, 0x00, 0x00, // no next IFD
+	}
+	out := append([]byte{}, jpegData[:2]...)
+	out = append(out, app1...)
+	return append(out, jpegData[2:]...)
+}
+
 func createTestPNG(width, height int) []byte {
 	img := createColoredImage(width, height)
 	var buf bytes.Buffer
@@ -1125,6 +1146,20 @@ func createTestPNG(width, height int) []byte {
 	return buf.Bytes()
 }
 
+func createBorderedJPEG(width, height int) []byte {
+	img := createBorderedImage(width, height, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	return buf.Bytes()
+}
+
+func createPaddedPNG(width, height int) []byte {
+	img := createBorderedImage(width, height, color.RGBA{})
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
 func createTestGIF(width, height int) []byte {
 	img := createColoredImage(width, height)
 	var buf bytes.Buffer
@@ -1180,6 +1215,22 @@ func createColoredImage(width, height int) image.Image {
 	return img
 }
 
+// createBorderedImage draws a 96x64 red block at (48,32) on a border color.
+// The edges sit on JPEG MCU boundaries so compression doesn't smear them.
+func createBorderedImage(width, height int, border color.RGBA) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := border
+			if x >= 48 && x < 144 && y >= 32 && y < 96 {
+				c = color.RGBA{R: 200, G: 30, B: 30, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
 // ---------------------------------------------------------------------------
 // Benchmarks
 // ---------------------------------------------------------------------------
@@ -1375,6 +1426,7 @@ func TestIsSVGSource(t *testing.T) {
 		{"raster wins over svg url", "image/png", "https://example.com/pic.svg", png, false},
 		{"xml svg", "image/svg+xml", "https://example.com/x.svg", xmlSVG, true},
 		{"jpeg", "image/jpeg", "https://upload.wikimedia.org/wikipedia/commons/a/ab/Photo.jpg", createTestJPEG(8, 8), false},
+		{"heic wins over svg url", "image/svg+xml", "https://example.com/photo.svg", ftypBox("heic", "mif1", "heic"), false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -1386,6 +1438,44 @@ func TestIsSVGSource(t *testing.T) {
 	}
 }
 
+// ftypBox builds the ISO BMFF ftyp box a HEIF/MP4 file starts with
+func ftypBox(major string, compatible ...string) []byte {
+	size := 16 + 4*len(compatible)
+	b := []byte{0, 0, 0, byte(size), 'f', 't', 'y', 'p'}
+	b = append(b, major...)
+	b = append(b, 0, 0, 0, 0)
+	for _, c := range compatible {
+		b = append(b, c...)
+	}
+	// trailing meta box bytes must not be read as brands
+	return append(b, 0, 0, 0, 8, 'a', 'v', 'i', 'f')
+}
+
+func TestHEIFBrand(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		want string
+	}{
+		{"heic", ftypBox("heic", "mif1", "heic"), "heic"},
+		{"heix", ftypBox("heix", "mif1"), "heic"},
+		{"avif", ftypBox("avif", "mif1", "miaf"), "avif"},
+		{"mif1 with avif", ftypBox("mif1", "mif1", "miaf", "avif"), "avif"},
+		{"mif1 with heic", ftypBox("mif1", "mif1", "heic"), "heic"},
+		{"bare mif1", ftypBox("mif1"), "heic"},
+		{"mp4 video", ftypBox("isom", "iso2", "mp41"), ""},
+		{"jpeg", createTestJPEG(8, 8), ""},
+		{"short", []byte("ftyp"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := handlers.HeifBrandForTest(tt.body); got != tt.want {
+				t.Errorf("heifBrand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Spinner SVG format validation
 // ---------------------------------------------------------------------------
@@ -0,0 +1,97 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"image-resize/app/handlers"
+)
+
+func TestSplitSignature(t *testing.T) {
+	cases := []struct {
+		path     string
+		wantPath string
+		wantSig  string
+	}{
+		{"s:abc/w300", "w300", "abc"},
+		{"s:abc/c300x200&cam=top", "c300x200&cam=top", "abc"},
+		{"s:abc", "", "abc"},
+		{"w300", "w300", ""},
+		{"", "", ""},
+	}
+	for _, c := range cases {
+		gotPath, gotSig := handlers.SplitSignatureForTest(c.path)
+		if gotPath != c.wantPath || gotSig != c.wantSig {
+			t.Errorf("splitSignature(%q) = (%q, %q), want (%q, %q)",
+				c.path, gotPath, gotSig, c.wantPath, c.wantSig)
+		}
+	}
+}
+
+func TestSignedURLs(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+
+	handlers.SetSigningForTest("test-secret", handlers.SigningEnforce)
+	defer handlers.SetSigningForTest("", handlers.SigningOff)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Accept", "image/webp,*/*")
+		rec := httptest.NewRecorder()
+		handlers.ResizeHandler(rec, req)
+		return rec
+	}
+
+	src := ts.URL + "/test.png"
+
+	// Unsigned request is rejected under enforce
+	if rec := get("/r/w32?" + src); rec.Code != http.StatusForbidden {
+		t.Errorf("unsigned: code=%d, want 403", rec.Code)
+	}
+
+	signed, err := handlers.SignURL("w32", src)
+	if err != nil {
+		t.Fatalf("SignURL: %v", err)
+	}
+	if !strings.HasPrefix(signed, "/r/s:") {
+		t.Fatalf("signed URL %q should start with /r/s:", signed)
+	}
+	if rec := get(signed); rec.Code != http.StatusOK {
+		t.Errorf("signed: code=%d body=%q", rec.Code, rec.Body.String())
+	}
+
+	// Equivalent spelling shares the signature
+	sig := strings.TrimPrefix(strings.SplitN(signed, "/", 4)[2], "s:")
+	if rec := get("/r/s:" + sig + "/w_32?" + src); rec.Code != http.StatusOK {
+		t.Errorf("equivalent params: code=%d", rec.Code)
+	}
+
+	// Tampered params, format or source fail
+	for _, target := range []string{
+		"/r/s:" + sig + "/w64?" + src,
+		"/r/s:" + sig + "/w32.png?" + src,
+		"/r/s:" + sig + "/w32?" + ts.URL + "/test.jpeg",
+	} {
+		if rec := get(target); rec.Code != http.StatusForbidden {
+			t.Errorf("%s: code=%d, want 403", target, rec.Code)
+		}
+	}
+
+	// Format-only signed URL
+	signedPNG, err := handlers.SignURL(".png", src)
+	if err != nil {
+		t.Fatalf("SignURL .png: %v", err)
+	}
+	if rec := get(signedPNG); rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("%s: code=%d type=%q", signedPNG, rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	// Warn mode serves unsigned requests
+	handlers.SetSigningForTest("test-secret", handlers.SigningWarn)
+	if rec := get("/r/w32?" + src); rec.Code != http.StatusOK {
+		t.Errorf("warn mode unsigned: code=%d, want 200", rec.Code)
+	}
+}
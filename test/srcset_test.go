@@ -0,0 +1,181 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"image-resize/app/handlers"
+)
+
+func srcsetGet(t *testing.T, query string) (*httptest.ResponseRecorder, handlers.SrcsetResponse) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/srcset?"+query, nil)
+	rec := httptest.NewRecorder()
+	handlers.SrcsetHandler(rec, req)
+	var resp handlers.SrcsetResponse
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode /srcset JSON: %v", err)
+		}
+	}
+	return rec, resp
+}
+
+func TestSrcsetMarkup(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg"
+	origin := "http://example.com" // httptest default host
+
+	rec, resp := srcsetGet(t, "url="+url.QueryEscape(src)+"&widths=160,80,160&f=auto&q=70&sizes=50vw&alt=A+%22cat%22")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code=%d body=%q", rec.Code, rec.Body.String())
+	}
+	if len(resp.Widths) != 2 || resp.Widths[0] != 80 || resp.Widths[1] != 160 {
+		t.Errorf("widths = %v, want sorted and deduplicated [80 160]", resp.Widths)
+	}
+	if len(resp.Variants) != 6 {
+		t.Errorf("got %d variants, want 6 (2 widths x avif, webp, negotiated)", len(resp.Variants))
+	}
+	wantSrcset := origin + "/r/w80&q=70?" + src + " 80w, " + origin + "/r/w160&q=70?" + src + " 160w"
+	if resp.Srcset != wantSrcset {
+		t.Errorf("srcset = %q, want %q", resp.Srcset, wantSrcset)
+	}
+	if len(resp.Sources) != 2 || resp.Sources[0].Type != "image/avif" || resp.Sources[1].Type != "image/webp" {
+		t.Errorf("sources = %+v, want avif then webp", resp.Sources)
+	}
+	if !strings.Contains(resp.Sources[0].Srcset, "/r/w80&q=70.avif?") {
+		t.Errorf("avif source srcset %q should force .avif", resp.Sources[0].Srcset)
+	}
+	if !strings.Contains(resp.Img, `sizes="50vw"`) || !strings.Contains(resp.Img, `alt="A &#34;cat&#34;"`) {
+		t.Errorf("img markup %q should carry escaped sizes and alt", resp.Img)
+	}
+	if !strings.HasPrefix(resp.Picture, "<picture>\n  <source type=\"image/avif\"") || !strings.HasSuffix(resp.Picture, "</picture>") {
+		t.Errorf("picture markup = %q", resp.Picture)
+	}
+
+	// Generated URLs resolve through the resize handler
+	path := strings.TrimPrefix(resp.Variants[0].URL, origin)
+	if rec := resizeGet(path, ""); rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/avif" {
+		t.Errorf("%s: code=%d type=%q", path, rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	for _, bad := range []string{"", "&w=300", "&widths=abc", "&widths=99999", "&f=glb", "&fit=pad"} {
+		query := "url=" + url.QueryEscape(src) + bad
+		if bad == "" {
+			query = "widths=320"
+		}
+		if rec, _ := srcsetGet(t, query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: code=%d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+func TestSrcsetSignedAndWarm(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.png"
+
+	handlers.SetSigningForTest("test-secret", handlers.SigningEnforce)
+	defer handlers.SetSigningForTest("", handlers.SigningOff)
+
+	rec, resp := srcsetGet(t, "url="+url.QueryEscape(src)+"&widths=48,96&f=webp&warm=1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code=%d body=%q", rec.Code, rec.Body.String())
+	}
+	if !resp.Signed || resp.Warmed != 2 {
+		t.Errorf("signed=%v warmed=%d, want signed with 2 warmed variants", resp.Signed, resp.Warmed)
+	}
+
+	path := strings.TrimPrefix(resp.Variants[0].URL, "http://example.com")
+	if !strings.HasPrefix(path, "/r/s:") {
+		t.Fatalf("variant %q should be signed", path)
+	}
+
+	// Warmed variant lands in the cache and passes signature enforcement
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec := resizeGet(path, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: code=%d body=%q", path, rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("X-Cache") == "HIT" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: warmed variant never became a cache HIT", path)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Already cached variants aren't queued again
+	if _, resp := srcsetGet(t, "url="+url.QueryEscape(src)+"&widths=48&f=webp&warm=1"); resp.Warmed != 0 {
+		t.Errorf("re-warm queued %d variants, want 0", resp.Warmed)
+	}
+
+	// Values needing escapes are signed as ResizeHandler decodes them
+	rec, resp = srcsetGet(t, "url="+url.QueryEscape(src)+"&widths=96&f=png&txt="+url.QueryEscape("SOLD OUT"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("txt with space: code=%d body=%q", rec.Code, rec.Body.String())
+	}
+	path = strings.TrimPrefix(resp.Variants[0].URL, "http://example.com")
+	if !strings.Contains(path, "txt=SOLD%20OUT") {
+		t.Errorf("variant %q should escape the space", path)
+	}
+	if rec := resizeGet(path, ""); rec.Code != http.StatusOK {
+		t.Errorf("%s: code=%d body=%q", path, rec.Code, rec.Body.String())
+	}
+	if rec, _ := srcsetGet(t, "url="+url.QueryEscape(src)+"&widths=96&txt="+url.QueryEscape("A&B")); rec.Code != http.StatusBadRequest {
+		t.Errorf("txt with '&': code=%d, want 400", rec.Code)
+	}
+}
+
+func TestSrcsetSourceEscaping(t *testing.T) {
+	data := createTestJPEG(200, 150)
+	var gotQuery string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(data)
+	}))
+	defer ts.Close()
+	const query = "n=a%20b+c,d"
+	src := ts.URL + "/test.jpeg?" + query
+
+	for _, key := range []string{"", "test-secret"} {
+		mode := handlers.SigningOff
+		if key != "" {
+			mode = handlers.SigningEnforce
+		}
+		handlers.SetSigningForTest(key, mode)
+		rec, resp := srcsetGet(t, "url="+url.QueryEscape(src)+"&widths=48,96")
+		handlers.SetSigningForTest("", handlers.SigningOff)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("signing key %q: code=%d body=%q", key, rec.Code, rec.Body.String())
+		}
+		if resp.Src != src {
+			t.Errorf("signing key %q: src %q, want %q", key, resp.Src, src)
+		}
+		if n := len(strings.Split(resp.Srcset, ", ")); n != 2 {
+			t.Errorf("signing key %q: srcset %q splits into %d entries, want 2", key, resp.Srcset, n)
+		}
+
+		// The returned URL fetches the source as given, signature intact
+		handlers.SetSigningForTest(key, mode)
+		gotQuery = ""
+		rec = resizeGet(strings.TrimPrefix(resp.Variants[1].URL, "http://example.com"), "")
+		handlers.SetSigningForTest("", handlers.SigningOff)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("signing key %q: %s: code=%d body=%q", key, resp.Variants[1].URL, rec.Code, rec.Body.String())
+		}
+		// The signed pass may be served from cache without a fetch
+		if (key == "" || gotQuery != "") && gotQuery != query {
+			t.Errorf("signing key %q: source fetched with query %q, want %q", key, gotQuery, query)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package test
 
 import (
+	"net/http"
+	"strings"
 	"testing"
 
 	"image-resize/app/handlers"
@@ -78,19 +80,52 @@ func TestParseBg(t *testing.T) {
 		{"TRANSPARENT", true, "transparent"},
 		{"white", false, "white"},
 		{"WHITE", false, "white"},
+		{"#FFF", false, "white"},
+		{"f0a", false, "ff00aa"},
+		{"1A2B3C", false, "1a2b3c"},
 	} {
 		transparent, key, err := handlers.ParseBgForTest(c.in)
 		if err != nil || transparent != c.transparent || key != c.key {
 			t.Errorf("parseBg(%q) = (%v, %q, %v), want (%v, %q, nil)", c.in, transparent, key, err, c.transparent, c.key)
 		}
 	}
-	for _, bad := range []string{"black", "opaque", "0"} {
+	for _, bad := range []string{"black", "opaque", "0", "12345", "ggg"} {
 		if _, _, err := handlers.ParseBgForTest(bad); err == nil {
 			t.Errorf("parseBg(%q) should fail", bad)
 		}
 	}
 }
 
+func TestStepBgSignatures(t *testing.T) {
+	handlers.SetSigningForTest("test-secret", handlers.SigningEnforce)
+	defer handlers.SetSigningForTest("", handlers.SigningOff)
+	src := "https://example.com/part.step"
+
+	// Signatures minted before hex colors existed still match
+	for _, c := range []struct {
+		params, sig string
+	}{
+		{"w300", "UepjATG-kocb2lM-2uNPyw"},
+		{"w300&bg=white", "ByeGUjOUkwdXgEuzOQ3CtA"},
+		{"w300&bg=FFF", "ByeGUjOUkwdXgEuzOQ3CtA"},
+	} {
+		signed, err := handlers.SignURL(c.params, src)
+		if err != nil {
+			t.Fatalf("SignURL(%q): %v", c.params, err)
+		}
+		if !strings.HasPrefix(signed, "/r/s:"+c.sig+"/") {
+			t.Errorf("SignURL(%q) = %q, want signature %s", c.params, signed, c.sig)
+		}
+	}
+
+	// f3d renders on transparent or white only; black was never accepted
+	for _, bg := range []string{"f0f0f0", "black"} {
+		if rec := resizeGet("/r/w300&bg="+bg+"?"+src, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("STEP bg=%s: code=%d, want 400", bg, rec.Code)
+		}
+	}
+}
+
 func TestStepSourceCacheKey(t *testing.T) {
 	cases := []struct {
 		cam, bg, want string
@@ -0,0 +1,175 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"image-resize/app/handlers"
+)
+
+// watermarkServer serves a solid green 100x50 PNG at /wm.png and counts hits.
+func watermarkServer(hits *int32) *httptest.Server {
+	mark := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 100; x++ {
+			mark.Set(x, y, color.RGBA{G: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, mark)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+}
+
+func TestWatermark(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg" // 200x150
+
+	var hits int32
+	wmServer := watermarkServer(&hits)
+	defer wmServer.Close()
+
+	err := handlers.LoadWatermarksForTest(map[string]handlers.Watermark{
+		"brand": {Src: wmServer.URL + "/wm.png", Scale: 0.5},
+		"faint": {Src: wmServer.URL + "/wm.png", Scale: 0.5, Gravity: "northwest", Margin: 10, Opacity: 0.5},
+	})
+	if err != nil {
+		t.Fatalf("load watermarks: %v", err)
+	}
+	defer handlers.LoadWatermarksForTest(nil)
+
+	pixel := func(rec *httptest.ResponseRecorder, x, y int) (uint32, uint32, uint32) {
+		img, _, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		r, g, b, _ := img.At(x, y).RGBA()
+		return r >> 8, g >> 8, b >> 8
+	}
+	isGreen := func(r, g, b uint32) bool { return r < 40 && g > 150 && b < 40 }
+
+	// Scaled to 100x50 (half the output width) in the bottom-right corner
+	rec := resizeGet("/r/w200&wm=brand.png?"+src, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("wm=brand: code=%d body=%q", rec.Code, rec.Body.String())
+	}
+	if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params=w_200_wm-brand;") {
+		t.Errorf("wm=brand: X-Info %q, want params=w_200_wm-brand", info)
+	}
+	if r, g, b := pixel(rec, 150, 125); !isGreen(r, g, b) {
+		t.Errorf("wm=brand: watermark pixel = (%d, %d, %d), want green", r, g, b)
+	}
+	if r, g, b := pixel(rec, 50, 25); isGreen(r, g, b) {
+		t.Errorf("wm=brand: pixel outside the watermark is green")
+	}
+
+	// Half opacity, top-left inset by the margin
+	rec = resizeGet("/r/w200&wm=faint.png?"+src, "")
+	if r, g, b := pixel(rec, 5, 5); isGreen(r, g, b) {
+		t.Errorf("wm=faint: margin pixel is green")
+	}
+	if r, _, b := pixel(rec, 30, 30); r > 40 || b < 40 || b > 90 {
+		t.Errorf("wm=faint: blended pixel red=%d blue=%d, want half-covered", r, b)
+	}
+
+	// Jpeg output stays opaque, asset is downloaded once for all variants
+	if rec := resizeGet("/r/w120&wm=brand.jpg?"+src, ""); rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("wm=brand jpg: code=%d type=%q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("watermark fetched %d times, want 1", n)
+	}
+
+	// Every frame of an animation carries it
+	anim := animServer()
+	defer anim.Close()
+	rec = resizeGet("/r/w200&wm=brand?"+anim.URL+"/anim.gif", "")
+	if info := rec.Header().Get("X-Info"); rec.Code != http.StatusOK || !strings.Contains(info, "frames=3") {
+		t.Fatalf("animated wm=brand: code=%d info=%q", rec.Code, info)
+	}
+	frames, err := gif.DecodeAll(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("animated wm=brand: decode: %v", err)
+	}
+	for i, frame := range frames.Image {
+		if r, g, b, _ := frame.At(150, 110).RGBA(); !isGreen(r>>8, g>>8, b>>8) {
+			t.Errorf("animated wm=brand: frame %d watermark pixel = (%d, %d, %d), want green", i, r>>8, g>>8, b>>8)
+		}
+	}
+
+	if rec := resizeGet("/r/w200&wm=nope?"+src, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown wm: code=%d, want 400", rec.Code)
+	}
+}
+
+func TestWatermarkDomainEnforcement(t *testing.T) {
+	ts := imageServer()
+	defer ts.Close()
+	src := ts.URL + "/test.jpeg"
+
+	var hits int32
+	wmServer := watermarkServer(&hits)
+	defer wmServer.Close()
+
+	err := handlers.LoadWatermarksForTest(map[string]handlers.Watermark{
+		"brand": {Src: wmServer.URL + "/wm.png"},
+		"stock": {Src: wmServer.URL + "/wm.png", Domains: []string{"127.0.0.1"}},
+	})
+	if err != nil {
+		t.Fatalf("load watermarks: %v", err)
+	}
+	defer handlers.LoadWatermarksForTest(nil)
+
+	// Applied without wm=, and explicit wm=stock shares the cache entry
+	for _, target := range []string{"/r/w200.png?", "/r/w200&wm=stock.png?"} {
+		rec := resizeGet(target+src, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: code=%d body=%q", target, rec.Code, rec.Body.String())
+		}
+		if info := rec.Header().Get("X-Info"); !strings.Contains(info, "params=w_200_wm-stock;") {
+			t.Errorf("%s: X-Info %q, want params=w_200_wm-stock", target, info)
+		}
+	}
+
+	if rec := resizeGet("/r/w200&wm=brand?"+src, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("other wm on enforced domain: code=%d, want 403", rec.Code)
+	}
+
+	// A trailing-dot hostname is the same host
+	err = handlers.LoadWatermarksForTest(map[string]handlers.Watermark{
+		"stock": {Src: wmServer.URL + "/wm.png", Domains: []string{"*.stockpartner.com"}},
+	})
+	if err != nil {
+		t.Fatalf("load watermarks: %v", err)
+	}
+	for _, u := range []string{"https://cdn.stockpartner.com/a.jpg", "https://cdn.stockpartner.com./a.jpg", "https://StockPartner.com./a.jpg"} {
+		if got := handlers.DomainWatermarkForTest(u); got != "stock" {
+			t.Errorf("%s: domain watermark %q, want stock", u, got)
+		}
+	}
+
+	err = handlers.LoadWatermarksForTest(map[string]handlers.Watermark{
+		"smart":   {Src: wmServer.URL + "/wm.png", Gravity: "attention"},
+		"huge":    {Src: wmServer.URL + "/wm.png", Scale: 2},
+		"nosrc":   {},
+		"missing": {Src: "does-not-exist.png"},
+	})
+	for _, name := range []string{"smart", "huge", "nosrc", "missing"} {
+		if err == nil || !strings.Contains(err.Error(), "'"+name+"'") {
+			t.Errorf("invalid watermark %q not reported: %v", name, err)
+		}
+	}
+}